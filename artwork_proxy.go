@@ -0,0 +1,352 @@
+package jellyplexgatherer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "image/gif"
+	_ "image/png"
+)
+
+const (
+	ArtworkPoster   = "poster"
+	ArtworkBackdrop = "backdrop"
+	ArtworkAvatar   = "avatar"
+)
+
+var (
+	ErrNoArtwork          = errors.New("session has no artwork of that kind")
+	ErrArtworkHostBlocked = errors.New("artwork url points to a host that isn't a configured server")
+)
+
+// Image paths for a Jellyfin session, episodes and tracks use their series or album art
+func getJellyImages(session jellySessionSummary) (images SessionImages) {
+	item := session.NowPlayingItem
+	switch {
+	case item.SeriesID != "" && item.SeriesPrimaryImageTag != "":
+		images.Poster = fmt.Sprintf("/Items/%s/Images/Primary?tag=%s", item.SeriesID, item.SeriesPrimaryImageTag)
+	case item.AlbumID != "" && item.AlbumPrimaryImageTag != "":
+		images.Poster = fmt.Sprintf("/Items/%s/Images/Primary?tag=%s", item.AlbumID, item.AlbumPrimaryImageTag)
+	case item.ImageTags["Primary"] != "":
+		images.Poster = fmt.Sprintf("/Items/%s/Images/Primary?tag=%s", item.ID, item.ImageTags["Primary"])
+	}
+	switch {
+	case len(item.BackdropImageTags) > 0:
+		images.Backdrop = fmt.Sprintf("/Items/%s/Images/Backdrop/0?tag=%s", item.ID, item.BackdropImageTags[0])
+	case item.ParentBackdropItemID != "" && len(item.ParentBackdropImageTags) > 0:
+		images.Backdrop = fmt.Sprintf("/Items/%s/Images/Backdrop/0?tag=%s", item.ParentBackdropItemID, item.ParentBackdropImageTags[0])
+	}
+	if session.UserPrimaryImageTag != "" {
+		images.Avatar = fmt.Sprintf("/Users/%s/Images/Primary?tag=%s", session.UserID, session.UserPrimaryImageTag)
+	}
+	return images
+}
+
+// Image paths for a Plex session, episodes use the show's poster and tracks their album cover
+func getPlexImages(session PlexVideoSession) (images SessionImages) {
+	images.Poster = session.Thumb
+	if session.GrandparentThumb != "" && session.Type != "track" {
+		images.Poster = session.GrandparentThumb
+	}
+	images.Backdrop = session.Art
+	if images.Backdrop == "" {
+		images.Backdrop = session.GrandparentArt
+	}
+	images.Avatar = session.User.Thumb
+	return images
+}
+
+// ArtworkProxy fetches session artwork with the server credentials, resizes it and caches it
+// on disk, so dashboards can show posters without handing tokens to browsers.
+//
+// As an http.Handler it serves ?service=Plex&session=<SessionID>&kind=poster&width=300&height=450,
+// only for sessions returned by Sessions, so it can't be abused to read arbitrary server paths.
+// Absolute artwork urls are only fetched from the configured servers, plex.tv (Plex avatars)
+// and AllowedHosts.
+type ArtworkProxy struct {
+	JellyfinAddress, JellyfinApiKey string
+	PlexAddress, PlexApiKey         string
+	CacheDir                        string        // empty disables the disk cache
+	CacheTTL                        time.Duration // how long a cached image is served, defaults to 24h
+	Sessions                        func() []SessionData
+	MaxSize                         int      // upper bound for requested width/height, defaults to 2000
+	AllowedHosts                    []string // extra host[:port]s absolute artwork urls may point to
+
+	mu        sync.Mutex
+	lastPrune time.Time
+}
+
+func NewArtworkProxy(jellyfinAddress, jellyfinApiKey, plexAddress, plexApiKey, cacheDir string, sessions func() []SessionData) *ArtworkProxy {
+	return &ArtworkProxy{
+		JellyfinAddress: jellyfinAddress,
+		JellyfinApiKey:  jellyfinApiKey,
+		PlexAddress:     plexAddress,
+		PlexApiKey:      plexApiKey,
+		CacheDir:        cacheDir,
+		CacheTTL:        24 * time.Hour,
+		Sessions:        sessions,
+		MaxSize:         2000,
+	}
+}
+
+// Fetch returns the session's artwork as JPEG, scaled to fit width x height (0 keeps the original size)
+func (p *ArtworkProxy) Fetch(session SessionData, kind string, width, height int) ([]byte, error) {
+	var path string
+	switch kind {
+	case ArtworkPoster:
+		path = session.Images.Poster
+	case ArtworkBackdrop:
+		path = session.Images.Backdrop
+	case ArtworkAvatar:
+		path = session.Images.Avatar
+	}
+	if path == "" {
+		return nil, ErrNoArtwork
+	}
+
+	cacheFile := ""
+	if p.CacheDir != "" {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%dx%d", session.Service, path, width, height)))
+		cacheFile = filepath.Join(p.CacheDir, hex.EncodeToString(sum[:])+".jpg")
+		if info, err := os.Stat(cacheFile); err == nil && time.Since(info.ModTime()) < p.cacheTTL() {
+			if cached, err := os.ReadFile(cacheFile); err == nil {
+				return cached, nil
+			}
+		}
+	}
+
+	endpoint, err := p.imageURL(session.Service, path)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := HTTPClient.Get(endpoint)
+	if err != nil {
+		// The url carries the server credentials
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			if parsed, parseErr := url.Parse(urlErr.URL); parseErr == nil {
+				urlErr.URL = redactURL(parsed)
+			}
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s artwork: %s", session.Service, resp.Status)
+	}
+	src, _, err := image.Decode(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s artwork: %v", session.Service, err)
+	}
+
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, resizeToFit(src, width, height), &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	if cacheFile != "" {
+		writeCacheFile(cacheFile, out.Bytes())
+		p.pruneCache(time.Now())
+	}
+	return out.Bytes(), nil
+}
+
+func (p *ArtworkProxy) cacheTTL() time.Duration {
+	if p.CacheTTL <= 0 {
+		return 24 * time.Hour
+	}
+	return p.CacheTTL
+}
+
+// Remove expired images, at most once per TTL, so artwork of finished sessions doesn't pile up
+func (p *ArtworkProxy) pruneCache(now time.Time) {
+	ttl := p.cacheTTL()
+	p.mu.Lock()
+	if now.Sub(p.lastPrune) < ttl {
+		p.mu.Unlock()
+		return
+	}
+	p.lastPrune = now
+	p.mu.Unlock()
+
+	entries, err := os.ReadDir(p.CacheDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && !entry.IsDir() && now.Sub(info.ModTime()) >= ttl {
+			os.Remove(filepath.Join(p.CacheDir, entry.Name()))
+		}
+	}
+}
+
+func (p *ArtworkProxy) imageURL(service, path string) (string, error) {
+	target, err := url.Parse(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s artwork path %q: %v", service, path, err)
+	}
+	if target.Scheme != "" || target.Host != "" {
+		if !p.allowedHost(target) {
+			return "", fmt.Errorf("%w: %s", ErrArtworkHostBlocked, target.Redacted())
+		}
+		return path, nil
+	}
+	switch service {
+	case "Jellyfin":
+		return p.JellyfinAddress + path + queryJoiner(path) + "api_key=" + url.QueryEscape(p.JellyfinApiKey), nil
+	case "Plex":
+		return p.PlexAddress + path + queryJoiner(path) + "X-Plex-Token=" + url.QueryEscape(p.PlexApiKey), nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnknownService, service)
+}
+
+// Absolute urls come from the servers' responses, only follow them to hosts we know
+func (p *ArtworkProxy) allowedHost(target *url.URL) bool {
+	if target.Host == "" {
+		return false
+	}
+	hosts := append([]string{}, p.AllowedHosts...)
+	for _, address := range []string{p.JellyfinAddress, p.PlexAddress, PlexTVAddress} {
+		if parsed, err := url.Parse(address); err == nil && parsed.Host != "" {
+			hosts = append(hosts, parsed.Host)
+		}
+	}
+	for _, host := range hosts {
+		if strings.EqualFold(target.Host, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func queryJoiner(path string) string {
+	if strings.Contains(path, "?") {
+		return "&"
+	}
+	return "?"
+}
+
+func (p *ArtworkProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	service, sessionID, kind := query.Get("service"), query.Get("session"), query.Get("kind")
+	if kind == "" {
+		kind = ArtworkPoster
+	}
+	maxSize := p.MaxSize
+	if maxSize <= 0 {
+		maxSize = 2000
+	}
+	width, _ := strconv.Atoi(query.Get("width"))
+	height, _ := strconv.Atoi(query.Get("height"))
+	if width < 0 || height < 0 || width > maxSize || height > maxSize {
+		http.Error(w, "invalid size", http.StatusBadRequest)
+		return
+	}
+
+	var session *SessionData
+	if p.Sessions != nil {
+		for _, candidate := range p.Sessions() {
+			if candidate.Service == service && candidate.SessionID == sessionID {
+				session = &candidate
+				break
+			}
+		}
+	}
+	if session == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	data, err := p.Fetch(*session, kind, width, height)
+	if errors.Is(err, ErrNoArtwork) {
+		http.NotFound(w, r)
+		return
+	}
+	if errors.Is(err, ErrArtworkHostBlocked) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		// Errors can name upstream urls, keep the details in the log
+		logger().Error("fetching artwork failed", "service", service, "session", sessionID, "kind", kind, "error", err)
+		http.Error(w, fmt.Sprintf("fetching artwork from %s failed", strings.ToLower(service)), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(data)
+}
+
+// Write to a temp file first so concurrent readers never see a partial image
+func writeCacheFile(path string, data []byte) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".artwork-*")
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(tmp, bytes.NewReader(data))
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+// Scale down to fit inside width x height keeping the aspect ratio, averaging the source
+// pixels under each destination pixel. Images are never scaled up.
+func resizeToFit(src image.Image, width, height int) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if srcW == 0 || srcH == 0 || (width <= 0 && height <= 0) {
+		return src
+	}
+	scale := 1.0
+	if width > 0 {
+		scale = min(scale, float64(width)/float64(srcW))
+	}
+	if height > 0 {
+		scale = min(scale, float64(height)/float64(srcH))
+	}
+	if scale >= 1 {
+		return src
+	}
+	dstW := max(1, int(float64(srcW)*scale))
+	dstH := max(1, int(float64(srcH)*scale))
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0 := bounds.Min.Y + y*srcH/dstH
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*srcH/dstH)
+		for x := 0; x < dstW; x++ {
+			x0 := bounds.Min.X + x*srcW/dstW
+			x1 := max(x0+1, bounds.Min.X+(x+1)*srcW/dstW)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,125 @@
+package jellyplexgatherer
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func artworkServer(t *testing.T) (*httptest.Server, *int32) {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 400, 600)))
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.URL.Query().Get("X-Plex-Token") != "plextoken" {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(server.Close)
+	return server, &hits
+}
+
+func TestArtworkProxyCache(t *testing.T) {
+	server, hits := artworkServer(t)
+	dir := t.TempDir()
+	session := SessionData{Service: "Plex", SessionID: "s1", Images: SessionImages{Poster: "/library/metadata/1/thumb/1"}}
+	proxy := NewArtworkProxy("", "", server.URL, "plextoken", dir, func() []SessionData { return []SessionData{session} })
+	proxy.CacheTTL = time.Hour
+
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/?service=Plex&session=s1&width=100&height=100", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", recorder.Code, recorder.Body)
+	}
+	img, err := jpeg.Decode(recorder.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size.X != 66 || size.Y != 100 {
+		t.Errorf("resized to %v, want 66x100", size)
+	}
+
+	if _, err := proxy.Fetch(session, ArtworkPoster, 100, 100); err != nil || *hits != 1 {
+		t.Fatalf("cached image not used: %v, %d requests", err, *hits)
+	}
+
+	// An expired image is fetched again
+	files, _ := filepath.Glob(filepath.Join(dir, "*.jpg"))
+	if len(files) != 1 {
+		t.Fatalf("got cache files %v", files)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(files[0], old, old)
+	if _, err := proxy.Fetch(session, ArtworkPoster, 100, 100); err != nil || *hits != 2 {
+		t.Errorf("expired image not refetched: %v, %d requests", err, *hits)
+	}
+
+	// Expired images of other sessions are pruned
+	stale := filepath.Join(dir, "stale.jpg")
+	os.WriteFile(stale, []byte("x"), 0o644)
+	os.Chtimes(stale, old, old)
+	proxy.pruneCache(time.Now().Add(2 * time.Hour))
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale cache file kept: %v", err)
+	}
+}
+
+func TestArtworkProxyHosts(t *testing.T) {
+	server, hits := artworkServer(t)
+	proxy := NewArtworkProxy("", "", server.URL, "plextoken", "", nil)
+
+	for _, poster := range []string{"http://169.254.169.254/latest/meta-data", "HTTPS://evil.example/x.png", "//evil.example/x.png"} {
+		session := SessionData{Service: "Plex", Images: SessionImages{Poster: poster}}
+		if _, err := proxy.Fetch(session, ArtworkPoster, 0, 0); err == nil {
+			t.Errorf("fetched %s", poster)
+		}
+	}
+	session := SessionData{Service: "Plex", Images: SessionImages{Poster: "http://169.254.169.254/latest/meta-data"}}
+	if _, err := proxy.Fetch(session, ArtworkPoster, 0, 0); !errors.Is(err, ErrArtworkHostBlocked) {
+		t.Errorf("got %v, want %v", err, ErrArtworkHostBlocked)
+	}
+	if *hits != 0 {
+		t.Errorf("made %d requests for blocked urls", *hits)
+	}
+
+	// Absolute urls on a configured server are fine, without credentials attached
+	session.Images.Poster = server.URL + "/photo/thumb?X-Plex-Token=plextoken"
+	if _, err := proxy.Fetch(session, ArtworkPoster, 0, 0); err != nil {
+		t.Errorf("fetching from the configured server: %v", err)
+	}
+}
+
+func TestArtworkProxyHidesCredentials(t *testing.T) {
+	// Nothing listens on the discard port
+	sessions := []SessionData{
+		{Service: "Plex", SessionID: "s1", Images: SessionImages{Poster: "/library/metadata/1/thumb"}},
+		{Service: "Jellyfin", SessionID: "s2", Images: SessionImages{Poster: "/Items/1/Images/Primary"}},
+	}
+	proxy := NewArtworkProxy("http://127.0.0.1:9", "JELLYSECRET", "http://127.0.0.1:9", "PLEXSECRET", "", func() []SessionData { return sessions })
+
+	for _, query := range []string{"service=Plex&session=s1", "service=Jellyfin&session=s2"} {
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+		body := recorder.Body.String()
+		if recorder.Code != http.StatusBadGateway || strings.Contains(body, "SECRET") || strings.Contains(body, "127.0.0.1") {
+			t.Errorf("%s: got %d %q", query, recorder.Code, body)
+		}
+	}
+	if _, err := proxy.Fetch(sessions[0], ArtworkPoster, 0, 0); err == nil || strings.Contains(err.Error(), "PLEXSECRET") {
+		t.Errorf("Fetch error leaks the token: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package jellyplexgatherer
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+const (
+	LocationLAN = "lan"
+	LocationWAN = "wan"
+)
+
+// NetworkClassifier re-tags sessions as LAN or WAN from configured CIDR lists.
+// Remote wins over Local so e.g. a VPN range inside 10.0.0.0/8 can still count as WAN.
+// Addresses matching neither keep whatever the gatherer decided.
+type NetworkClassifier struct {
+	Local  []*net.IPNet
+	Remote []*net.IPNet
+}
+
+// Build a classifier from CIDR strings like "192.168.1.0/24"
+func NewNetworkClassifier(localCIDRs, remoteCIDRs []string) (*NetworkClassifier, error) {
+	local, err := parseCIDRs(localCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := parseCIDRs(remoteCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	return &NetworkClassifier{Local: local, Remote: remote}, nil
+}
+
+// Classify returns the sessions with Location set according to the CIDR lists
+func (c *NetworkClassifier) Classify(sessions []SessionData) []SessionData {
+	classified := make([]SessionData, len(sessions))
+	for i, session := range sessions {
+		if ip := parseEndPoint(session.IPAddress); ip != nil {
+			switch {
+			case containsIP(c.Remote, ip):
+				session.Location = LocationWAN
+			case containsIP(c.Local, ip):
+				session.Location = LocationLAN
+			}
+		}
+		classified[i] = session
+	}
+	return classified
+}
+
+// ServerBandwidth is the bandwidth used by one server's streams, in Mbps
+type ServerBandwidth struct {
+	Service    string
+	Total      float64
+	LAN        float64
+	WAN        float64
+	LANStreams int
+	WANStreams int
+}
+
+// AggregateBandwidth sums session bandwidth per server, sorted by service name
+func AggregateBandwidth(sessions []SessionData) []ServerBandwidth {
+	byService := make(map[string]*ServerBandwidth)
+	for _, session := range sessions {
+		aggregate, ok := byService[session.Service]
+		if !ok {
+			aggregate = &ServerBandwidth{Service: session.Service}
+			byService[session.Service] = aggregate
+		}
+		aggregate.Total += session.Bandwidth
+		if session.Location == LocationWAN {
+			aggregate.WAN += session.Bandwidth
+			aggregate.WANStreams++
+		} else {
+			aggregate.LAN += session.Bandwidth
+			aggregate.LANStreams++
+		}
+	}
+	aggregates := make([]ServerBandwidth, 0, len(byService))
+	for _, aggregate := range byService {
+		aggregates = append(aggregates, *aggregate)
+	}
+	sort.Slice(aggregates, func(i, j int) bool {
+		return aggregates[i].Service < aggregates[j].Service
+	})
+	return aggregates
+}
+
+// Fallback when the server gives no hint, private and loopback addresses are LAN
+func locationFromAddress(address string) string {
+	ip := parseEndPoint(address)
+	if ip == nil {
+		return ""
+	}
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return LocationLAN
+	}
+	return LocationWAN
+}
+
+// Jellyfin sometimes reports the end point with a port or as an IPv4-mapped IPv6 address
+func parseEndPoint(address string) net.IP {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	return net.ParseIP(strings.Trim(address, "[]"))
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package jellyplexgatherer
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	BudgetActionDowngrade = "downgrade"
+	BudgetActionStop      = "stop"
+)
+
+type BudgetSuggestion struct {
+	Session SessionData
+	Action  string // downgrade direct streams first, stop streams that already transcode
+}
+
+// BudgetEvent is raised when remote bandwidth crosses the upload cap and again when it recovers
+type BudgetEvent struct {
+	Time        time.Time
+	Exceeded    bool
+	WAN         float64 // Mbps used by remote streams across all servers
+	Cap         float64
+	Suggestions []BudgetSuggestion // largest streams first, enough to get back under the cap
+}
+
+// BandwidthGuard compares aggregate remote bitrate against an upload cap. It alerts once the
+// cap has been exceeded for Debounce and only clears once usage drops below ClearRatio*Cap,
+// so streams hovering around the cap don't flap. Paused sessions don't count, they send nothing.
+type BandwidthGuard struct {
+	UploadCap  float64       // Mbps
+	ClearRatio float64       // defaults to 0.9
+	Debounce   time.Duration // how long the cap must be exceeded before alerting
+	OnEvent    func(BudgetEvent)
+
+	mu        sync.Mutex
+	exceeded  bool
+	overSince time.Time
+}
+
+func NewBandwidthGuard(uploadCap float64, onEvent func(BudgetEvent)) *BandwidthGuard {
+	return &BandwidthGuard{UploadCap: uploadCap, ClearRatio: 0.9, OnEvent: onEvent}
+}
+
+// Check a snapshot, returns the event if the state changed
+func (g *BandwidthGuard) Check(sessions []SessionData) *BudgetEvent {
+	return g.check(sessions, time.Now())
+}
+
+func (g *BandwidthGuard) check(sessions []SessionData, now time.Time) (event *BudgetEvent) {
+	// OnEvent may take its time or check again, call it after unlocking
+	defer func() {
+		if event != nil && g.OnEvent != nil {
+			g.OnEvent(*event)
+		}
+	}()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	sessions = activeSessions(sessions)
+	var wan float64
+	for _, aggregate := range AggregateBandwidth(sessions) {
+		wan += aggregate.WAN
+	}
+	clearRatio := g.ClearRatio
+	if clearRatio <= 0 || clearRatio > 1 {
+		clearRatio = 0.9
+	}
+
+	switch {
+	case !g.exceeded && wan > g.UploadCap:
+		if g.overSince.IsZero() {
+			g.overSince = now
+		}
+		if now.Sub(g.overSince) >= g.Debounce {
+			g.exceeded = true
+			event = &BudgetEvent{Time: now, Exceeded: true, WAN: wan, Cap: g.UploadCap,
+				Suggestions: budgetSuggestions(sessions, wan-g.UploadCap)}
+		}
+	case !g.exceeded:
+		g.overSince = time.Time{}
+	case g.exceeded && wan < g.UploadCap*clearRatio:
+		g.exceeded = false
+		g.overSince = time.Time{}
+		event = &BudgetEvent{Time: now, Exceeded: false, WAN: wan, Cap: g.UploadCap}
+	}
+	return event
+}
+
+// Run checks every snapshot coming from a SessionWatcher subscription until ctx is done. With
+// a Debounce the last snapshot is also rechecked in between, so an overload is reported once
+// it has lasted Debounce even if no snapshot arrives at that moment.
+func (g *BandwidthGuard) Run(ctx context.Context, events <-chan SessionEvent) {
+	var recheck <-chan time.Time
+	if g.Debounce > 0 {
+		ticker := time.NewTicker(max(g.Debounce/2, 10*time.Millisecond))
+		defer ticker.Stop()
+		recheck = ticker.C
+	}
+	var last []SessionData
+	received := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-recheck:
+			if received {
+				g.Check(last)
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Type == EventSnapshot {
+				last, received = event.Sessions, true
+				g.Check(last)
+			}
+		}
+	}
+}
+
+func activeSessions(sessions []SessionData) (active []SessionData) {
+	for _, session := range sessions {
+		if session.State != "paused" {
+			active = append(active, session)
+		}
+	}
+	return active
+}
+
+func budgetSuggestions(sessions []SessionData, excess float64) (suggestions []BudgetSuggestion) {
+	var remote []SessionData
+	for _, session := range sessions {
+		if session.Location == LocationWAN {
+			remote = append(remote, session)
+		}
+	}
+	sort.SliceStable(remote, func(i, j int) bool {
+		return remote[i].Bandwidth > remote[j].Bandwidth
+	})
+	var freed float64
+	for _, session := range remote {
+		if freed >= excess {
+			break
+		}
+		action := BudgetActionDowngrade
+		if session.IsTranscode() {
+			action = BudgetActionStop
+		}
+		suggestions = append(suggestions, BudgetSuggestion{Session: session, Action: action})
+		freed += session.Bandwidth
+	}
+	return suggestions
+}
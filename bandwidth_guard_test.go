@@ -0,0 +1,85 @@
+package jellyplexgatherer
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBandwidthGuard(t *testing.T) {
+	guard := NewBandwidthGuard(20, nil)
+	guard.Debounce = time.Minute
+	sessions := []SessionData{
+		{SessionID: "1", Location: LocationWAN, Bandwidth: 12, PlayMethod: "DirectPlay", State: "playing"},
+		{SessionID: "2", Location: LocationWAN, Bandwidth: 10, PlayMethod: "Transcode", State: "playing"},
+		{SessionID: "3", Location: LocationLAN, Bandwidth: 40, State: "playing"},
+	}
+
+	start := time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC)
+	if event := guard.check(sessions, start); event != nil {
+		t.Fatalf("alerted before the debounce: %+v", event)
+	}
+	event := guard.check(sessions, start.Add(time.Minute))
+	if event == nil || !event.Exceeded || event.WAN != 22 {
+		t.Fatalf("got %+v, want an exceeded event at 22 Mbps", event)
+	}
+	if len(event.Suggestions) != 1 || event.Suggestions[0].Session.SessionID != "1" || event.Suggestions[0].Action != BudgetActionDowngrade {
+		t.Errorf("unexpected suggestions %+v", event.Suggestions)
+	}
+
+	// 19 Mbps is under the cap but not under ClearRatio*Cap
+	sessions[0].Bandwidth = 9
+	if event := guard.check(sessions, start.Add(2*time.Minute)); event != nil {
+		t.Errorf("cleared above the clear ratio: %+v", event)
+	}
+
+	// Pausing sends nothing, so it clears
+	sessions[0].State = "paused"
+	event = guard.check(sessions, start.Add(3*time.Minute))
+	if event == nil || event.Exceeded || event.WAN != 10 {
+		t.Errorf("got %+v, want a cleared event at 10 Mbps", event)
+	}
+}
+
+func TestBandwidthGuardSteadyOverload(t *testing.T) {
+	alerts := make(chan BudgetEvent, 1)
+	guard := NewBandwidthGuard(10, func(event BudgetEvent) { alerts <- event })
+	guard.Debounce = 50 * time.Millisecond
+
+	// A single snapshot, nothing changes afterwards
+	events := make(chan SessionEvent, 1)
+	events <- SessionEvent{Type: EventSnapshot, Sessions: []SessionData{{Location: LocationWAN, Bandwidth: 15, State: "playing"}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go guard.Run(ctx, events)
+
+	select {
+	case event := <-alerts:
+		if !event.Exceeded {
+			t.Errorf("got %+v, want an exceeded event", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("steady overload never alerted")
+	}
+}
+
+func TestBandwidthGuardCallbackOutsideLock(t *testing.T) {
+	sessions := []SessionData{{SessionID: "1", Location: LocationWAN, Bandwidth: 30, State: "playing"}}
+	var guard *BandwidthGuard
+	var rechecked *BudgetEvent
+	guard = NewBandwidthGuard(20, func(event BudgetEvent) {
+		// Checking again from the callback must not deadlock
+		rechecked = guard.Check(sessions)
+	})
+
+	done := make(chan *BudgetEvent, 1)
+	go func() { done <- guard.Check(sessions) }()
+	select {
+	case event := <-done:
+		if event == nil || !event.Exceeded || rechecked != nil {
+			t.Errorf("got %+v and %+v from the callback, want one exceeded event", event, rechecked)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnEvent was called with the lock held")
+	}
+}
@@ -0,0 +1,109 @@
+package jellyplexgatherer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEndPoint(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"192.168.1.20", "192.168.1.20"},
+		{"192.168.1.20:51234", "192.168.1.20"},
+		{"::ffff:10.0.0.5", "10.0.0.5"},
+		{"2001:db8::2b", "2001:db8::2b"},
+		{"[::1]:8096", "::1"},
+		{"[2001:db8::2b]", "2001:db8::2b"},
+		{"", ""},
+		{"jellyfin.example.com", ""},
+		{"300.1.1.1", ""},
+		{"192.168.1.20:port:extra", ""},
+	}
+	for _, test := range tests {
+		got := parseEndPoint(test.address)
+		if test.want == "" && got != nil || test.want != "" && got.String() != test.want {
+			t.Errorf("parseEndPoint(%q) = %v, want %q", test.address, got, test.want)
+		}
+	}
+}
+
+func TestNetworkClassifier(t *testing.T) {
+	// The VPN range sits inside the local one
+	classifier, err := NewNetworkClassifier([]string{"10.0.0.0/8", " fd00::/8"}, []string{"10.8.0.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		address  string
+		location string // what the gatherer decided
+		want     string
+	}{
+		{"10.1.2.3", LocationWAN, LocationLAN},
+		{"10.8.0.7:40000", LocationLAN, LocationWAN},
+		{"[fd00::15]:8096", LocationWAN, LocationLAN},
+		{"::ffff:10.8.0.9", LocationLAN, LocationWAN},
+		// Matching neither list or unparseable keeps the gatherer's answer
+		{"203.0.113.5", LocationWAN, LocationWAN},
+		{"[::1]:8096", LocationWAN, LocationWAN},
+		{"not an address", LocationLAN, LocationLAN},
+		{"", "", ""},
+	}
+	sessions := make([]SessionData, len(tests))
+	for i, test := range tests {
+		sessions[i] = SessionData{IPAddress: test.address, Location: test.location}
+	}
+	classified := classifier.Classify(sessions)
+	for i, test := range tests {
+		if classified[i].Location != test.want {
+			t.Errorf("%q classified as %q, want %q", test.address, classified[i].Location, test.want)
+		}
+		if sessions[i].Location != test.location {
+			t.Errorf("Classify changed the input session for %q", test.address)
+		}
+	}
+
+	for _, cidrs := range [][]string{{"10.0.0.0"}, {"10.0.0.0/33"}, {"fd00::/8", "nonsense"}} {
+		if _, err := NewNetworkClassifier(nil, cidrs); err == nil {
+			t.Errorf("accepted %q", cidrs)
+		}
+	}
+}
+
+func TestLocationFromAddress(t *testing.T) {
+	tests := map[string]string{
+		"192.168.1.20:51234": LocationLAN,
+		"[::1]:8096":         LocationLAN,
+		"fe80::1":            LocationLAN,
+		"203.0.113.5":        LocationWAN,
+		"[2001:db8::2b]:443": LocationWAN,
+		"garbage":            "",
+	}
+	for address, want := range tests {
+		if got := locationFromAddress(address); got != want {
+			t.Errorf("locationFromAddress(%q) = %q, want %q", address, got, want)
+		}
+	}
+}
+
+func TestAggregateBandwidth(t *testing.T) {
+	sessions := []SessionData{
+		{Service: "Plex", Location: LocationWAN, Bandwidth: 8},
+		{Service: "Jellyfin", Location: LocationLAN, Bandwidth: 20},
+		{Service: "Plex", Location: LocationLAN, Bandwidth: 4.5},
+		{Service: "Plex", Location: LocationWAN, Bandwidth: 2},
+		// Unknown locations count as LAN
+		{Service: "Jellyfin", Bandwidth: 1.5},
+	}
+	want := []ServerBandwidth{
+		{Service: "Jellyfin", Total: 21.5, LAN: 21.5, LANStreams: 2},
+		{Service: "Plex", Total: 14.5, LAN: 4.5, WAN: 10, LANStreams: 1, WANStreams: 2},
+	}
+	if got := AggregateBandwidth(sessions); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := AggregateBandwidth(nil); len(got) != 0 {
+		t.Errorf("got %+v for no sessions", got)
+	}
+}
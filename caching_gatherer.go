@@ -0,0 +1,177 @@
+package jellyplexgatherer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ServerSessions is one server's sessions as served by a CachingGatherer
+type ServerSessions struct {
+	Service   string // "Jellyfin" or "Plex"
+	Sessions  []SessionData
+	FetchedAt time.Time
+	Stale     bool  // the last refresh failed, Sessions are from FetchedAt
+	Err       error // why the last refresh failed
+}
+
+// CacheStats counts how CachingGatherer answered per server lookups
+type CacheStats struct {
+	Hits      uint64 // served from a fresh cache entry
+	Misses    uint64 // went upstream
+	Coalesced uint64 // waited for another caller's upstream request
+	Stale     uint64 // upstream failed, served the previous sessions
+	Errors    uint64 // upstream failed with nothing cached to fall back on
+}
+
+// CachingGatherer sits in front of GetJellySessions and GetPlexSessions for apps that ask for
+// sessions from many goroutines. Results are cached for TTL, concurrent callers share one
+// upstream request per server and a failed refresh falls back to the last good sessions.
+//
+// GetAllSessions has the same signature as the package function, so it can be handed to
+// NewSessionWatcherFunc.
+type CachingGatherer struct {
+	JellyfinAddress, JellyfinApiKey string
+	PlexAddress, PlexApiKey         string
+	TTL                             time.Duration
+
+	mu       sync.Mutex
+	entries  map[string]*ServerSessions
+	inflight map[string]*cacheCall
+	stats    CacheStats
+}
+
+type cacheCall struct {
+	done   chan struct{}
+	result ServerSessions
+}
+
+func NewCachingGatherer(jellyfinAddress, jellyfinApiKey, plexAddress, plexApiKey string, ttl time.Duration) *CachingGatherer {
+	return &CachingGatherer{
+		JellyfinAddress: jellyfinAddress,
+		JellyfinApiKey:  jellyfinApiKey,
+		PlexAddress:     plexAddress,
+		PlexApiKey:      plexApiKey,
+		TTL:             ttl,
+	}
+}
+
+// Servers returns the sessions of every configured server, with their age and staleness
+func (g *CachingGatherer) Servers() []ServerSessions {
+	var servers []ServerSessions
+	if g.JellyfinAddress != "" || g.JellyfinApiKey != "" {
+		servers = append(servers, g.get("Jellyfin", func() ([]SessionData, error) {
+			return GetJellySessions(g.JellyfinAddress, g.JellyfinApiKey)
+		}))
+	}
+	if g.PlexAddress != "" || g.PlexApiKey != "" {
+		servers = append(servers, g.get("Plex", func() ([]SessionData, error) {
+			return GetPlexSessions(g.PlexAddress, g.PlexApiKey)
+		}))
+	}
+	return servers
+}
+
+// GetAllSessions is the cached GetAllSessions. Stale sessions are returned together with
+// an error describing the failed refresh.
+func (g *CachingGatherer) GetAllSessions() (allSessions []SessionData, errors string) {
+	for _, server := range g.Servers() {
+		allSessions = append(allSessions, server.Sessions...)
+		if server.Err == nil {
+			continue
+		}
+		if errors != "" {
+			errors += "\n"
+		}
+		if server.Stale {
+			errors += fmt.Sprintf("Error getting %s sessions, serving sessions from %s: %s", server.Service, server.FetchedAt.Format(time.TimeOnly), server.Err)
+		} else {
+			errors += fmt.Sprintf("Error getting %s sessions: %s", server.Service, server.Err)
+		}
+	}
+	return allSessions, errors
+}
+
+// Invalidate drops the cached sessions, the next call goes upstream
+func (g *CachingGatherer) Invalidate() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.entries = nil
+}
+
+func (g *CachingGatherer) Stats() CacheStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.stats
+}
+
+// Metrics returns the cache counters as a "session_cache" point for the metric exporters
+func (g *CachingGatherer) Metrics(now time.Time) MetricPoint {
+	stats := g.Stats()
+	return MetricPoint{
+		Name: "session_cache",
+		Tags: map[string]string{},
+		Fields: map[string]float64{
+			"hits":      float64(stats.Hits),
+			"misses":    float64(stats.Misses),
+			"coalesced": float64(stats.Coalesced),
+			"stale":     float64(stats.Stale),
+			"errors":    float64(stats.Errors),
+		},
+		Time: now,
+	}
+}
+
+func (g *CachingGatherer) get(service string, fetch func() ([]SessionData, error)) ServerSessions {
+	g.mu.Lock()
+	if entry := g.entries[service]; entry != nil && entry.Err == nil && time.Since(entry.FetchedAt) < g.TTL {
+		g.stats.Hits++
+		result := *entry
+		g.mu.Unlock()
+		return result.clone()
+	}
+	if call := g.inflight[service]; call != nil {
+		g.stats.Coalesced++
+		g.mu.Unlock()
+		<-call.done
+		return call.result.clone()
+	}
+	g.stats.Misses++
+	call := &cacheCall{done: make(chan struct{})}
+	if g.inflight == nil {
+		g.inflight = make(map[string]*cacheCall)
+	}
+	g.inflight[service] = call
+	g.mu.Unlock()
+
+	sessions, err := fetch()
+	now := time.Now()
+
+	g.mu.Lock()
+	if g.entries == nil {
+		g.entries = make(map[string]*ServerSessions)
+	}
+	previous := g.entries[service]
+	switch {
+	case err == nil:
+		call.result = ServerSessions{Service: service, Sessions: sessions, FetchedAt: now}
+		g.entries[service] = &call.result
+	case previous != nil:
+		g.stats.Stale++
+		call.result = ServerSessions{Service: service, Sessions: previous.Sessions, FetchedAt: previous.FetchedAt, Stale: true, Err: err}
+		g.entries[service] = &call.result
+	default:
+		g.stats.Errors++
+		call.result = ServerSessions{Service: service, Err: err}
+	}
+	delete(g.inflight, service)
+	g.mu.Unlock()
+	close(call.done)
+	return call.result.clone()
+}
+
+// Every caller gets its own slice so nobody can modify the cached sessions
+func (s ServerSessions) clone() ServerSessions {
+	s.Sessions = append([]SessionData(nil), s.Sessions...)
+	return s
+}
@@ -0,0 +1,343 @@
+// Command capturefixture saves the live session list of a Jellyfin or Plex server as a test
+// fixture, with user names, device names, ids, addresses and file paths replaced by stable
+// pseudonyms and tokens in urls removed, so the file can be committed.
+//
+//	capturefixture -service jellyfin -address http://jellyfin:8096 -o testdata/fixtures/jellyfin/10.9.11-music.json
+//	capturefixture -service plex -address http://plex:32400 -o testdata/fixtures/plex/1.41.3-live-tv.xml
+//
+// The token is read from -token or from JELLYFIN_API_KEY / PLEX_TOKEN. Media titles, codecs
+// and stream details are kept, they're what the parsers are tested against. Always read the
+// output before committing it, a scrubber can't know about a user name someone typed into a
+// device name field of an unknown client.
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+func main() {
+	service := flag.String("service", "", "jellyfin or plex")
+	address := flag.String("address", "", "server address, e.g. http://localhost:8096")
+	token := flag.String("token", "", "API key or X-Plex-Token, defaults to $JELLYFIN_API_KEY or $PLEX_TOKEN")
+	output := flag.String("o", "", "output file, defaults to stdout")
+	raw := flag.Bool("raw", false, "don't scrub the response (never commit the result)")
+	flag.Parse()
+
+	var endpoint string
+	switch *service {
+	case "jellyfin":
+		if *token == "" {
+			*token = os.Getenv("JELLYFIN_API_KEY")
+		}
+		endpoint = strings.TrimRight(*address, "/") + "/Sessions?api_key=" + url.QueryEscape(*token)
+	case "plex":
+		if *token == "" {
+			*token = os.Getenv("PLEX_TOKEN")
+		}
+		endpoint = strings.TrimRight(*address, "/") + "/status/sessions?X-Plex-Token=" + url.QueryEscape(*token)
+	default:
+		log.Fatalf("unknown -service %q, want jellyfin or plex", *service)
+	}
+	if *address == "" {
+		log.Fatal("-address is required")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *service == "plex" {
+		req.Header.Set("Accept", "application/xml")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(strings.ReplaceAll(err.Error(), url.QueryEscape(*token), "REDACTED"))
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("%s returned %s", *service, resp.Status)
+	}
+
+	if !*raw {
+		s := newScrubber()
+		if *service == "jellyfin" {
+			body, err = s.scrubJSON(body)
+		} else {
+			body, err = s.scrubXML(body)
+		}
+		if err != nil {
+			log.Fatalf("scrubbing response: %v", err)
+		}
+	}
+
+	if *output == "" {
+		os.Stdout.Write(body)
+		return
+	}
+	if err := os.WriteFile(*output, body, 0o644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %s", *output)
+}
+
+// scrubber hands out pseudonyms that are stable within one capture, so the same user or
+// item keeps the same replacement everywhere in the file, but differ between captures
+type scrubber struct {
+	salt   []byte
+	seen   map[string]string
+	counts map[string]int
+}
+
+func newScrubber() *scrubber {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	return &scrubber{salt: salt, seen: make(map[string]string), counts: make(map[string]int)}
+}
+
+// Sequential names, e.g. user1, user2, Device 1
+func (s *scrubber) name(kind, format, value string) string {
+	if value == "" {
+		return value
+	}
+	key := kind + "\x00" + value
+	if name, ok := s.seen[key]; ok {
+		return name
+	}
+	s.counts[kind]++
+	name := fmt.Sprintf(format, s.counts[kind])
+	s.seen[key] = name
+	return name
+}
+
+// Replace an id with a salted hash of the same shape: digits stay digits, separators stay
+func (s *scrubber) id(value string) string {
+	if value == "" {
+		return value
+	}
+	sum := sha256.Sum256(append(append([]byte(nil), s.salt...), value...))
+	const hexDigits = "0123456789abcdef"
+	var out strings.Builder
+	for i, c := range value {
+		b := sum[i%len(sum)] ^ byte(i/len(sum))
+		switch {
+		case c >= '0' && c <= '9':
+			out.WriteByte('0' + b%10)
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			out.WriteByte(hexDigits[b%16])
+		default:
+			out.WriteRune(c)
+		}
+	}
+	return out.String()
+}
+
+// Map addresses into documentation ranges, keeping whether they were private and the port
+func (s *scrubber) address(value string) string {
+	host, port := value, ""
+	if h, p, err := net.SplitHostPort(value); err == nil {
+		host, port = h, p
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return s.name("host", "host%d.example.com", value)
+	}
+	var replacement string
+	switch {
+	case ip.IsLoopback():
+		replacement = ip.String()
+	case ip.To4() == nil:
+		replacement = s.name("ipv6", "2001:db8::%x", ip.String())
+	case ip.IsPrivate():
+		replacement = s.name("lan", "192.168.1.%d", ip.String())
+	default:
+		replacement = s.name("wan", "203.0.113.%d", ip.String())
+	}
+	if port != "" {
+		return net.JoinHostPort(replacement, port)
+	}
+	if strings.HasPrefix(host, "[") {
+		return "[" + replacement + "]"
+	}
+	return replacement
+}
+
+// Library paths are reduced to the file name
+func (s *scrubber) path(value string) string {
+	if value == "" {
+		return value
+	}
+	return "/media/" + path.Base(strings.ReplaceAll(value, `\`, "/"))
+}
+
+// Some clients put the server token into urls they report back, e.g. artwork links
+var tokenParam = regexp.MustCompile(`(?i)\b(X-Plex-Token|api_key|ApiKey|X-Emby-Token)=[^&"'\s]*`)
+
+func (s *scrubber) tokens(value string) string {
+	return tokenParam.ReplaceAllString(value, "${1}=REDACTED")
+}
+
+func (s *scrubber) jellyValue(key, value string) string {
+	switch {
+	case key == "UserName":
+		return s.name("user", "user%d", value)
+	case key == "DeviceName":
+		return s.name("device", "Device %d", value)
+	case key == "RemoteEndPoint":
+		return s.address(value)
+	case key == "Path":
+		return s.path(value)
+	case key == "PlaylistItemId":
+		return value
+	case key == "Id" || strings.HasSuffix(key, "Id") || key == "ETag" || key == "Etag":
+		return s.id(value)
+	}
+	return s.tokens(value)
+}
+
+// Re-encode the JSON token by token so key order matches what the server sent
+func (s *scrubber) scrubJSON(body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var out bytes.Buffer
+	if err := s.copyJSON(dec, &out, ""); err != nil {
+		return nil, err
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, out.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	indented.WriteByte('\n')
+	return indented.Bytes(), nil
+}
+
+func (s *scrubber) copyJSON(dec *json.Decoder, out *bytes.Buffer, key string) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch token := token.(type) {
+	case json.Delim:
+		out.WriteRune(rune(token))
+		first := true
+		for dec.More() {
+			if !first {
+				out.WriteByte(',')
+			}
+			first = false
+			childKey := key
+			if token == '{' {
+				keyToken, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				childKey, _ = keyToken.(string)
+				writeJSON(out, childKey)
+				out.WriteByte(':')
+			}
+			if err := s.copyJSON(dec, out, childKey); err != nil {
+				return err
+			}
+		}
+		end, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		out.WriteRune(rune(end.(json.Delim)))
+	case string:
+		writeJSON(out, s.jellyValue(key, token))
+	case json.Number:
+		out.WriteString(token.String())
+	default:
+		writeJSON(out, token)
+	}
+	return nil
+}
+
+func writeJSON(out *bytes.Buffer, v interface{}) {
+	data, _ := json.Marshal(v)
+	out.Write(data)
+}
+
+func (s *scrubber) plexValue(element, attr, value string) string {
+	switch element + "." + attr {
+	case "User.title", "Account.title", "Account.name":
+		return s.name("user", "user%d", value)
+	case "User.id", "Player.userID", "Account.id":
+		return s.name("userid", "%d", value)
+	case "User.thumb", "Account.thumb":
+		return s.avatar(value)
+	case "Player.title":
+		return s.name("device", "Device %d", value)
+	case "Player.address", "Player.remotePublicAddress":
+		return s.address(value)
+	case "Player.machineIdentifier", "Session.id", "TranscodeSession.key":
+		return s.id(value)
+	case "Part.file":
+		return s.path(value)
+	}
+	return s.tokens(value)
+}
+
+// plex.tv avatar URLs carry the account's uuid
+func (s *scrubber) avatar(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil || value == "" {
+		return ""
+	}
+	parts := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "users" {
+		return ""
+	}
+	return parsed.Scheme + "://" + parsed.Host + "/users/" + s.id(parts[1]) + "/avatar"
+}
+
+func (s *scrubber) scrubXML(body []byte) ([]byte, error) {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	var out bytes.Buffer
+	enc := xml.NewEncoder(&out)
+	for {
+		token, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			start = start.Copy()
+			for i, attr := range start.Attr {
+				start.Attr[i].Value = s.plexValue(start.Name.Local, attr.Name.Local, attr.Value)
+			}
+			token = start
+		}
+		if err := enc.EncodeToken(token); err != nil {
+			return nil, err
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		out.WriteByte('\n')
+	}
+	return out.Bytes(), nil
+}
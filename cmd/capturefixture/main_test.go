@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func assertScrubbed(t *testing.T, out string, secrets, kept []string) {
+	t.Helper()
+	for _, secret := range secrets {
+		if strings.Contains(out, secret) {
+			t.Errorf("output still contains %q:\n%s", secret, out)
+		}
+	}
+	for _, want := range kept {
+		if !strings.Contains(out, want) {
+			t.Errorf("output lost %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestScrubXML(t *testing.T) {
+	raw := `<?xml version="1.0" encoding="UTF-8"?>
+<MediaContainer size="2">
+<Video title="Heat" thumb="/library/metadata/1/thumb?X-Plex-Token=s3cr3tT0ken"><Media><Part file="/mnt/nas/alice/Heat (1995).mkv" decision="directplay"/></Media>
+<User id="1234567" thumb="https://plex.tv/users/9f8e7d6c5b4a3210/avatar?c=1" title="alice.smith"/>
+<Player address="192.168.7.21" machineIdentifier="abc123def456" remotePublicAddress="81.2.69.142" title="Alice's iPad" userID="1234567"/>
+<Session id="zyx987" bandwidth="20000" location="lan"/></Video>
+<Track title="Teardrop"><User id="7654321" title="bob"/>
+<Player address="2a02:8108:1234::5" remotePublicAddress="81.2.69.142" title="Bob's Phone" userID="7654321"/></Track>
+</MediaContainer>`
+	out, err := newScrubber().scrubXML([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertScrubbed(t, string(out),
+		[]string{"s3cr3tT0ken", "alice", "bob", "1234567", "7654321", "9f8e7d6c5b4a3210", "192.168.7.21", "81.2.69.142", "2a02:8108", "abc123def456", "zyx987", "iPad", "Phone", "/mnt/nas"},
+		[]string{`title="Heat"`, `title="Teardrop"`, "X-Plex-Token=REDACTED", `file="/media/Heat (1995).mkv"`, `address="192.168.1.1"`, `address="2001:db8::1"`, `bandwidth="20000"`})
+
+	// Both players share a public address, which should still show
+	if strings.Count(string(out), `remotePublicAddress="203.0.113.1"`) != 2 {
+		t.Errorf("shared public address not mapped to one pseudonym:\n%s", out)
+	}
+}
+
+func TestScrubJSON(t *testing.T) {
+	raw := `[{"UserName":"alice.smith","UserId":"4f3e2d1c","DeviceName":"Alice's TV","DeviceId":"TW96aWxsYQ==","RemoteEndPoint":"[2a02:8108:1234::5]:51234","Id":"c0ffee42",
+"NowPlayingItem":{"Name":"Heat","Path":"D:\\Movies\\alice\\Heat.mkv","ImageUrl":"http://jellyfin:8096/Items/1/Images/Primary?api_key=s3cr3tK3y&maxWidth=300"}},
+{"UserName":"bob","RemoteEndPoint":"81.2.69.142","PlaylistItemId":"playlistItem0","PlayState":{"PositionTicks":123}}]`
+	out, err := newScrubber().scrubJSON([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertScrubbed(t, string(out),
+		[]string{"s3cr3tK3y", "alice", "bob", "4f3e2d1c", "TW96aWxsYQ", "2a02:8108", "81.2.69.142", "c0ffee42", `D:\\Movies`},
+		[]string{`"Name": "Heat"`, `api_key=REDACTED\u0026maxWidth=300`, `"[2001:db8::1]:51234"`, `"203.0.113.1"`, `"/media/Heat.mkv"`, `"playlistItem0"`, `"PositionTicks": 123`})
+}
+
+func TestScrubberStable(t *testing.T) {
+	s := newScrubber()
+	if s.name("user", "user%d", "alice") != "user1" || s.name("user", "user%d", "bob") != "user2" || s.name("user", "user%d", "alice") != "user1" {
+		t.Error("user pseudonyms aren't sequential and stable")
+	}
+	id := s.id("1a2b-3c4d")
+	if id != s.id("1a2b-3c4d") || len(id) != 9 || id[4] != '-' || id == "1a2b-3c4d" {
+		t.Errorf("got id %q, want a stable replacement of the same shape", id)
+	}
+	if other := newScrubber().id("1a2b-3c4d"); other == id {
+		t.Error("ids are the same across captures")
+	}
+}
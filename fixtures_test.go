@@ -0,0 +1,145 @@
+package jellyplexgatherer
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata/golden from the current parser output")
+
+// Every recorded response in testdata/fixtures is parsed and compared to the SessionData
+// in testdata/golden. New fixtures come from cmd/capturefixture, run with -update once and
+// review the golden diff before committing it. Fixtures written or edited by hand say so in
+// a comment at the top.
+func TestFixtureGoldenFiles(t *testing.T) {
+	gatherers := map[string]func(address, apiKey string) ([]SessionData, error){
+		"jellyfin": GetJellySessions,
+		"plex":     GetPlexSessions,
+	}
+	for service, gather := range gatherers {
+		fixtures, err := filepath.Glob(filepath.Join("testdata", "fixtures", service, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fixtures) == 0 {
+			t.Errorf("no %s fixtures", service)
+		}
+		for _, fixture := range fixtures {
+			service, fixture, gather := service, fixture, gather
+			name := strings.TrimSuffix(filepath.Base(fixture), filepath.Ext(fixture))
+			t.Run(service+"/"+name, func(t *testing.T) {
+				body, err := os.ReadFile(fixture)
+				if err != nil {
+					t.Fatal(err)
+				}
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if filepath.Ext(fixture) == ".xml" {
+						w.Header().Set("Content-Type", "text/xml;charset=utf-8")
+					} else {
+						w.Header().Set("Content-Type", "application/json; charset=utf-8")
+					}
+					w.Write(body)
+				}))
+				defer server.Close()
+
+				sessions, err := gather(server.URL, "token")
+				if err != nil {
+					t.Fatalf("parsing %s: %v", fixture, err)
+				}
+				got, err := json.MarshalIndent(sessions, "", "  ")
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, '\n')
+
+				golden := filepath.Join("testdata", "golden", service, name+".json")
+				if *update {
+					if err := os.WriteFile(golden, got, 0o644); err != nil {
+						t.Fatal(err)
+					}
+					return
+				}
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatalf("%v (run go test -update to create it)", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s doesn't match %s, run go test -update and review the diff\ngot:\n%s", fixture, golden, got)
+				}
+			})
+		}
+	}
+}
+
+// A /Sessions response from a busy server, every Jellyfin fixture session repeated
+func busyJellySessions(b *testing.B) []byte {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "fixtures", "jellyfin", "*.json"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var sessions []json.RawMessage
+	for _, fixture := range fixtures {
+		body, err := os.ReadFile(fixture)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var fixtureSessions []json.RawMessage
+		if err := json.Unmarshal(body, &fixtureSessions); err != nil {
+			b.Fatal(err)
+		}
+		sessions = append(sessions, fixtureSessions...)
+	}
+	var busy []json.RawMessage
+	for len(busy) < 200 {
+		busy = append(busy, sessions...)
+	}
+	body, err := json.Marshal(busy)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return body
+}
+
+func BenchmarkJellyDecodeFull(b *testing.B) {
+	body := busyJellySessions(b)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var sessions JellySessions
+		if err := json.Unmarshal(body, &sessions); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJellyDecodeSummary(b *testing.B) {
+	body := busyJellySessions(b)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeJellySessionSummaries(bytes.NewReader(body), false); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJellyDecodeSummarySkipQueue(b *testing.B) {
+	body := busyJellySessions(b)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeJellySessionSummaries(bytes.NewReader(body), true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,611 @@
+package jellyplexgatherer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Janczykkkko/jellyplexgatherer/testserver"
+)
+
+var (
+	alice = testserver.Session{
+		ID:            "s1",
+		UserID:        "u1",
+		UserName:      "alice",
+		DeviceID:      "d1",
+		DeviceName:    "Living Room TV",
+		Client:        "Jellyfin Web",
+		RemoteAddress: "192.168.1.20",
+		Local:         true,
+		Type:          "movie",
+		Title:         "Heat",
+		Year:          1995,
+		ProviderIDs:   map[string]string{"imdb": "tt0113277", "tmdb": "949"},
+		Bitrate:       8000,
+		Height:        1080,
+		Subtitle:      "English - SUBRIP",
+	}
+	bob = testserver.Session{
+		ID:            "s2",
+		UserID:        "u2",
+		UserName:      "bob",
+		DeviceID:      "d2",
+		DeviceName:    "Phone",
+		Client:        "Plex for Android",
+		RemoteAddress: "203.0.113.7",
+		Type:          "episode",
+		Title:         "Pilot",
+		SeriesTitle:   "Twin Peaks",
+		Season:        1,
+		Episode:       1,
+		Year:          1990,
+		ProviderIDs:   map[string]string{"tvdb": "4"},
+		Transcode:     true,
+		Bitrate:       4000,
+		Height:        720,
+	}
+)
+
+func TestGetAllSessions(t *testing.T) {
+	jellyfin := testserver.NewJellyfin("jellykey")
+	defer jellyfin.Close()
+	plex := testserver.NewPlex("plextoken")
+	defer plex.Close()
+
+	idle := testserver.Session{ID: "s3", UserName: "carol", DeviceName: "Chrome", Idle: true}
+	jellyfin.SetSessions(alice, idle)
+	plex.SetSessions(bob)
+
+	sessions, errs := GetAllSessions(jellyfin.URL, "jellykey", plex.URL, "plextoken")
+	if errs != "" {
+		t.Fatalf("unexpected errors: %s", errs)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("got %d sessions, want 2 (idle Jellyfin clients are skipped): %+v", len(sessions), sessions)
+	}
+
+	jelly, plexSession := sessions[0], sessions[1]
+	if jelly.Service != "Jellyfin" || jelly.UserName != "alice" || jelly.UserID != "u1" || jelly.SessionID != "s1" {
+		t.Errorf("unexpected Jellyfin session %+v", jelly)
+	}
+	if jelly.Bitrate != "8" || jelly.PlayMethod != "DirectPlay" || jelly.SubStream != "English - SUBRIP" || jelly.State != "playing" {
+		t.Errorf("unexpected Jellyfin playback %+v", jelly)
+	}
+	if jelly.Media.Key() != "imdb:tt0113277" || jelly.Media.String() != "Heat (1995)" {
+		t.Errorf("unexpected Jellyfin media %+v", jelly.Media)
+	}
+	if jelly.Location != LocationLAN {
+		t.Errorf("Jellyfin location = %q, want %q", jelly.Location, LocationLAN)
+	}
+
+	if plexSession.Service != "Plex" || plexSession.UserName != "bob" || plexSession.UserID != "u2" || plexSession.SessionID != "s2" {
+		t.Errorf("unexpected Plex session %+v", plexSession)
+	}
+	if !plexSession.IsTranscode() || plexSession.VideoHeight != 720 || plexSession.Location != LocationWAN {
+		t.Errorf("unexpected Plex playback %+v", plexSession)
+	}
+	if plexSession.Media.String() != "Twin Peaks S01E01 - Pilot" || plexSession.Media.ProviderIDs[ProviderTVDb] != "4" {
+		t.Errorf("unexpected Plex media %+v", plexSession.Media)
+	}
+}
+
+func TestGetAllSessionsErrors(t *testing.T) {
+	jellyfin := testserver.NewJellyfin("jellykey")
+	defer jellyfin.Close()
+	plex := testserver.NewPlex("plextoken")
+	defer plex.Close()
+
+	jellyfin.Play(testserver.Step{Status: http.StatusServiceUnavailable, Body: "starting up"})
+	plex.SetSessions(bob)
+
+	sessions, errs := GetAllSessions(jellyfin.URL, "jellykey", plex.URL, "wrongtoken")
+	if len(sessions) != 0 {
+		t.Errorf("got %d sessions from failing servers", len(sessions))
+	}
+	if errs == "" {
+		t.Error("expected errors from failing servers")
+	}
+}
+
+func TestGetJellySessionsWithOptions(t *testing.T) {
+	jellyfin := testserver.NewJellyfin("jellykey")
+	defer jellyfin.Close()
+
+	stale := bob
+	stale.Inactive = 2 * time.Hour
+	jellyfin.SetSessions(alice, stale)
+
+	tests := []struct {
+		name string
+		opts JellySessionOptions
+		want []string
+	}{
+		{"no filters", JellySessionOptions{}, []string{"s1", "s2"}},
+		{"active within", JellySessionOptions{ActiveWithin: 10 * time.Minute}, []string{"s1"}},
+		{"controllable by user", JellySessionOptions{ControllableByUserID: "u2"}, []string{"s2"}},
+		{"device", JellySessionOptions{DeviceID: "d1"}, []string{"s1"}},
+		{"skip queue items", JellySessionOptions{SkipQueueItems: true}, []string{"s1", "s2"}},
+	}
+	for _, test := range tests {
+		sessions, err := GetJellySessionsWithOptions(jellyfin.URL, "jellykey", test.opts)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var got []string
+		for _, session := range sessions {
+			got = append(got, session.SessionID)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got sessions %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	query := jellySessionsURL("http://jellyfin", "key", JellySessionOptions{ActiveWithin: 90500 * time.Millisecond, DeviceID: "d 1"})
+	if want := "http://jellyfin/Sessions?activeWithinSeconds=91&api_key=key&deviceId=d+1"; query != want {
+		t.Errorf("sessions url = %s, want %s", query, want)
+	}
+}
+
+func TestSkipJellyQueueItems(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "fixtures", "jellyfin", "10.9.11-episode-transcode-queue.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, err := decodeJellySessionSummaries(bytes.NewReader(body), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipped, err := decodeJellySessionSummaries(bytes.NewReader(body), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != len(full) {
+		t.Fatalf("got %d sessions skipping queue items, want %d", len(skipped), len(full))
+	}
+	queued := false
+	for i := range full {
+		queued = queued || len(full[i].NowPlayingQueueFullItems) > 0
+		if skipped[i].NowPlayingQueueFullItems != nil {
+			t.Errorf("session %s still has queue items", skipped[i].ID)
+		}
+		if skipped[i].ID != full[i].ID || skipped[i].NowPlayingItem.Name != full[i].NowPlayingItem.Name {
+			t.Errorf("session %s decoded differently when skipping queue items", full[i].ID)
+		}
+	}
+	if !queued {
+		t.Error("fixture has no queue items to skip")
+	}
+}
+
+func TestJellyBitrateWithoutMediaSources(t *testing.T) {
+	var session jellySessionSummary
+	json.Unmarshal([]byte(`{"PlayState":{"PlayMethod":"DirectPlay","PositionTicks":1},"NowPlayingQueueFullItems":[{"MediaSources":[]}]}`), &session)
+	if bitrate := getJellyStreamBitrate(session); bitrate != "None" {
+		t.Errorf("got bitrate %q, want None", bitrate)
+	}
+}
+
+func TestGetPlexUsers(t *testing.T) {
+	plex := testserver.NewPlex("plextoken")
+	defer plex.Close()
+	defer func(address string) { PlexTVAddress = address }(PlexTVAddress)
+	PlexTVAddress = plex.URL
+
+	plex.SetAccounts(
+		testserver.Account{ID: "1", PlexTVID: "9000001", Name: "owner", Title: "Owner", Username: "owner", Email: "owner@example.com", Home: true},
+		testserver.Account{ID: "u2", Name: "bob", Title: "Bobby", Username: "bob", Email: "bob@example.com"},
+		testserver.Account{ID: "u5", Name: "kid", Title: "Kiddo", Home: true},
+	)
+	plex.SetSessions(bob)
+
+	users, err := GetPlexUsers(plex.URL, "plextoken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := PlexUsers{
+		"1":  {ID: "1", Name: "Owner", Username: "owner", Email: "owner@example.com", Thumb: "https://plex.tv/users/1/avatar", Owner: true, Home: true},
+		"u2": {ID: "u2", Name: "Bobby", Username: "bob", Email: "bob@example.com", Thumb: "https://plex.tv/users/u2/avatar", Shared: true},
+		"u5": {ID: "u5", Name: "Kiddo", Thumb: "https://plex.tv/users/u5/avatar", Home: true, Managed: true},
+	}
+	if !reflect.DeepEqual(users, want) {
+		t.Errorf("got users\n%+v\nwant\n%+v", users, want)
+	}
+
+	sessions, err := GetPlexSessions(plex.URL, "plextoken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions = users.Resolve(sessions)
+	if sessions[0].UserID != "u2" || sessions[0].UserName != "Bobby" {
+		t.Errorf("resolved session user = %s (%s), want Bobby (u2)", sessions[0].UserName, sessions[0].UserID)
+	}
+
+	// Without plex.tv the server's account names are still there
+	PlexTVAddress = "http://127.0.0.1:1"
+	users, err = GetPlexUsers(plex.URL, "plextoken")
+	if err == nil {
+		t.Error("expected an error without plex.tv")
+	}
+	if users.Name("u2") != "bob" || !users["1"].Owner || len(users) != 3 {
+		t.Errorf("unexpected server accounts %+v", users)
+	}
+}
+
+func TestGetOnlineUsers(t *testing.T) {
+	jellyfin := testserver.NewJellyfin("jellykey")
+	defer jellyfin.Close()
+	start := time.Now().UTC().Add(-10 * time.Minute)
+	jellyfin.AddActivity(
+		testserver.Activity{Name: "alice is online from Chrome", Type: "SessionStarted", UserID: "u1", Date: start},
+		testserver.Activity{Name: "carol is online from Jellyfin Android", Type: "SessionStarted", UserID: "u3", Date: start.Add(time.Minute)},
+		testserver.Activity{Name: "alice is online from Living Room TV", Type: "SessionStarted", UserID: "u1", Date: start.Add(2 * time.Minute)},
+		testserver.Activity{Name: "alice has disconnected from Chrome", Type: "SessionEnded", UserID: "u1", Date: start.Add(3 * time.Minute)},
+		testserver.Activity{Name: "Heat was added to the library", Type: "ItemAdded", Date: start.Add(4 * time.Minute)},
+	)
+
+	log, err := GetJellyActivityLogData(jellyfin.URL, "jellykey", 60, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log.Items) != 5 || log.Items[0].Type != "ItemAdded" || log.Items[4].UserID != "u1" || !log.Items[4].Date.Equal(start) {
+		t.Errorf("unexpected activity log %+v", log.Items)
+	}
+
+	users, err := GetOnlineUsers(jellyfin.URL, "jellykey", 50, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].UserName < users[j].UserName })
+	want := JellyOnlineUsers{
+		{UserName: "alice", Device: "Living Room TV", Online: true},
+		{UserName: "carol", Device: "Jellyfin Android", Online: true},
+	}
+	if !reflect.DeepEqual(users, want) {
+		t.Errorf("got online users %+v, want %+v", users, want)
+	}
+
+	if _, err := GetOnlineUsers(jellyfin.URL, "wrong", 50, 60); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("got %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestSessionWatcherEvents(t *testing.T) {
+	jellyfin := testserver.NewJellyfin("jellykey")
+	defer jellyfin.Close()
+
+	paused := alice
+	paused.Paused = true
+	jellyfin.Play(
+		testserver.Step{},
+		testserver.Step{Sessions: []testserver.Session{alice}},
+		testserver.Step{Sessions: []testserver.Session{paused}},
+		testserver.Step{},
+	)
+
+	watcher := NewSessionWatcher(jellyfin.URL, "jellykey", "", "", 0)
+	events, cancel := watcher.Subscribe(0)
+	defer cancel()
+	for i := 0; i < 4; i++ {
+		watcher.Poll()
+	}
+
+	var types []string
+	for len(events) > 0 {
+		event := <-events
+		if event.Type != EventSnapshot {
+			types = append(types, event.Type)
+		}
+	}
+	want := []string{EventSessionStart, EventSessionPause, EventSessionStop}
+	if len(types) != len(want) {
+		t.Fatalf("got events %v, want %v", types, want)
+	}
+	for i := range want {
+		if types[i] != want[i] {
+			t.Fatalf("got events %v, want %v", types, want)
+		}
+	}
+	if jellyfin.Polls() != 4 {
+		t.Errorf("server was polled %d times, want 4", jellyfin.Polls())
+	}
+}
+
+func TestSessionWatcherPartialFailure(t *testing.T) {
+	jellyfin := testserver.NewJellyfin("jellykey")
+	defer jellyfin.Close()
+	plex := testserver.NewPlex("plextoken")
+	defer plex.Close()
+
+	jellyfin.Play(
+		testserver.Step{},
+		testserver.Step{Sessions: []testserver.Session{alice}},
+	)
+	plex.Play(
+		testserver.Step{Sessions: []testserver.Session{bob}},
+		testserver.Step{Status: http.StatusServiceUnavailable},
+		testserver.Step{Sessions: []testserver.Session{bob}},
+	)
+
+	watcher := NewSessionWatcher(jellyfin.URL, "jellykey", plex.URL, "plextoken", 0)
+	events, cancel := watcher.Subscribe(0)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		watcher.Poll()
+	}
+
+	var types []string
+	snapshots := 0
+	for len(events) > 0 {
+		event := <-events
+		switch event.Type {
+		case EventSnapshot:
+			snapshots++
+		case EventError:
+			if event.Service != "Plex" {
+				t.Errorf("error event for %s, want Plex", event.Service)
+			}
+			types = append(types, event.Type)
+		default:
+			types = append(types, event.Type+" "+event.Session.Service)
+		}
+	}
+	// bob keeps playing through the Plex outage, alice's start still comes through
+	want := []string{"start Plex", EventError, "start Jellyfin"}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("got events %v, want %v", types, want)
+	}
+	if snapshots != 3 {
+		t.Errorf("got %d snapshots, want one per poll", snapshots)
+	}
+	if sessions := watcher.Sessions(); len(sessions) != 2 {
+		t.Errorf("watcher has %d sessions, want 2", len(sessions))
+	}
+
+	// Run must not panic without an interval
+	ctx, stop := context.WithCancel(context.Background())
+	stop()
+	watcher.Run(ctx)
+}
+
+func TestJellySupportsCommand(t *testing.T) {
+	var session jellySessionSummary
+	commands := make([]string, 1, 4)
+	commands[0] = "SetVolume"
+	session.Capabilities.SupportedCommands = commands
+	session.SupportedCommands = []string{"DisplayMessage", "Play"}
+
+	if !jellySupportsCommand(session, "DisplayMessage") || !jellySupportsCommand(session, "SetVolume") || jellySupportsCommand(session, "SendString") {
+		t.Error("commands from either list not found")
+	}
+	// The spare capacity of the capabilities must stay untouched
+	if spare := commands[1:cap(commands)]; spare[0] != "" || spare[1] != "" {
+		t.Errorf("checking commands wrote %q into the session's slice", spare)
+	}
+}
+
+func TestKillAndMessageSession(t *testing.T) {
+	jellyfin := testserver.NewJellyfin("jellykey")
+	defer jellyfin.Close()
+	plex := testserver.NewPlex("plextoken")
+	defer plex.Close()
+	jellyfin.SetSessions(alice)
+	plex.SetSessions(bob)
+
+	sessions, errs := GetAllSessions(jellyfin.URL, "jellykey", plex.URL, "plextoken")
+	if errs != "" {
+		t.Fatalf("unexpected errors: %s", errs)
+	}
+	for _, session := range sessions {
+		if err := SendMessage(jellyfin.URL, "jellykey", plex.URL, "plextoken", session, Message{Header: "Hi", Text: "Server restarting"}); err != nil && !errors.Is(err, ErrMessageNotSupported) {
+			t.Errorf("messaging %s session: %v", session.Service, err)
+		}
+		if err := KillSession(jellyfin.URL, "jellykey", plex.URL, "plextoken", session, KillOptions{Reason: "Maintenance"}); err != nil {
+			t.Errorf("killing %s session: %v", session.Service, err)
+		}
+	}
+
+	if stopped := jellyfin.Stopped(); len(stopped) != 1 || stopped[0] != "s1" {
+		t.Errorf("Jellyfin stopped sessions %v", stopped)
+	}
+	if messages := jellyfin.Messages(); len(messages) != 1 || messages[0].Text != "Server restarting" {
+		t.Errorf("Jellyfin messages %+v", messages)
+	}
+	if stopped := plex.Stopped(); len(stopped) != 1 || stopped[0] != "s2" {
+		t.Errorf("Plex stopped sessions %v", stopped)
+	}
+	if messages := plex.Messages(); len(messages) != 1 || messages[0].Text != "Maintenance" {
+		t.Errorf("Plex termination reasons %+v", messages)
+	}
+
+	plex.PlexPass = false
+	err := KillPlexSession(plex.URL, "plextoken", "s2", KillOptions{})
+	if !errors.Is(err, ErrPlexPassRequired) {
+		t.Errorf("killing without Plex Pass: got %v, want %v", err, ErrPlexPassRequired)
+	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusForbidden || statusErr.Backend != "plex" {
+		t.Errorf("killing without Plex Pass: got %#v, want a 403 StatusError", err)
+	}
+	err = KillJellySession(jellyfin.URL, "wrongkey", "s1", KillOptions{})
+	if !errors.Is(err, ErrPermissionDenied) || !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("killing with a wrong key: got %v, want %v", err, ErrPermissionDenied)
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	jellyfin := testserver.NewJellyfin("jellykey")
+	plex := testserver.NewPlex("plextoken")
+	jellyfin.SetSessions(alice)
+	plex.Play(testserver.Step{Sessions: []testserver.Session{bob}}, testserver.Step{})
+
+	path := filepath.Join(t.TempDir(), "traffic.jsonl")
+	recorder, err := NewRecordingTransport(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(client *http.Client) { HTTPClient = client }(HTTPClient)
+	HTTPClient = &http.Client{Transport: recorder}
+
+	var recorded [][]SessionData
+	for i := 0; i < 2; i++ {
+		sessions, errs := GetAllSessions(jellyfin.URL, "jellykey", plex.URL, "plextoken")
+		if errs != "" {
+			t.Fatalf("unexpected errors: %s", errs)
+		}
+		recorded = append(recorded, sessions)
+	}
+	recorder.Close()
+	jellyfin.Close()
+	plex.Close()
+
+	traffic, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(traffic, []byte("jellykey")) || bytes.Contains(traffic, []byte("plextoken")) {
+		t.Errorf("recording contains credentials:\n%s", traffic)
+	}
+
+	replay, err := NewReplayTransport(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	HTTPClient = &http.Client{Transport: replay}
+	for i, want := range recorded {
+		got, errs := GetAllSessions(jellyfin.URL, "otherkey", plex.URL, "othertoken")
+		if errs != "" {
+			t.Fatalf("unexpected replay errors: %s", errs)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("replayed poll %d differs\ngot:  %+v\nwant: %+v", i, got, want)
+		}
+	}
+	if _, err := GetJellyServerInfo(jellyfin.URL, "jellykey"); !errors.Is(err, ErrNotRecorded) {
+		t.Errorf("unrecorded request: got %v, want %v", err, ErrNotRecorded)
+	}
+}
+
+func TestLogging(t *testing.T) {
+	plex := testserver.NewPlex("plextoken")
+	defer plex.Close()
+	plex.SetSessions(bob)
+
+	var logs bytes.Buffer
+	SetLogger(slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	defer SetLogger(nil)
+	if _, err := GetPlexSessions(plex.URL, "plextoken"); err != nil {
+		t.Fatal(err)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("expected one JSON log line, got %q: %v", logs.String(), err)
+	}
+	if entry["backend"] != "plex" || entry["server"] != plex.URL || entry["status"] != float64(http.StatusOK) || entry["duration"] == nil {
+		t.Errorf("missing request attributes in %v", entry)
+	}
+	if _, ok := entry["payload"]; ok {
+		t.Error("payload logged without SetPayloadLogging")
+	}
+
+	logs.Reset()
+	SetPayloadLogging(true)
+	defer SetPayloadLogging(false)
+	GetPlexSessions(plex.URL, "plextoken")
+	if !strings.Contains(logs.String(), `"payload":`) {
+		t.Errorf("payload missing from debug log %q", logs.String())
+	}
+
+	logs.Reset()
+	SetLogger(nil)
+	GetPlexSessions(plex.URL, "plextoken")
+	if logs.Len() != 0 {
+		t.Errorf("logged after SetLogger(nil): %q", logs.String())
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	jellyfin := testserver.NewJellyfin("jellykey")
+	defer jellyfin.Close()
+	plex := testserver.NewPlex("plextoken")
+	defer plex.Close()
+
+	_, err := GetPlexData(plex.URL, "wrongtoken")
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("got %v, want a StatusError matching ErrUnauthorized", err)
+	}
+	if statusErr.StatusCode != http.StatusUnauthorized || !strings.Contains(statusErr.Body, "401 Unauthorized") {
+		t.Errorf("unexpected status error %+v", statusErr)
+	}
+
+	jellyfin.Play(testserver.Step{Status: http.StatusBadGateway, Body: strings.Repeat("upstream down ", 100)})
+	_, err = GetJellyData(jellyfin.URL, "jellykey")
+	if !errors.Is(err, ErrServerError) || !errors.As(err, &statusErr) || len(statusErr.Body) > errorBodySnippet {
+		t.Errorf("got %v, want a ServerError with a truncated body", err)
+	}
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html><body>Please sign in</body></html>"))
+	}))
+	defer proxy.Close()
+	_, err = GetJellyData(proxy.URL, "jellykey")
+	var typeErr *ContentTypeError
+	if !errors.As(err, &typeErr) || !errors.Is(err, ErrUnexpectedContentType) || typeErr.ContentType != "text/html" {
+		t.Errorf("got %v, want a ContentTypeError for text/html", err)
+	}
+}
+
+func TestCachingGatherer(t *testing.T) {
+	plex := testserver.NewPlex("plextoken")
+	defer plex.Close()
+	plex.SetSessions(bob)
+	plex.SetDelay(50 * time.Millisecond)
+
+	gatherer := NewCachingGatherer("", "", plex.URL, "plextoken", time.Hour)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if sessions, errs := gatherer.GetAllSessions(); errs != "" || len(sessions) != 1 {
+				t.Errorf("got %d sessions, %q", len(sessions), errs)
+			}
+		}()
+	}
+	wg.Wait()
+	if plex.Polls() != 1 {
+		t.Errorf("concurrent calls made %d upstream requests, want 1", plex.Polls())
+	}
+	gatherer.GetAllSessions()
+	if stats := gatherer.Stats(); stats.Misses != 1 || stats.Coalesced+stats.Hits != 10 {
+		t.Errorf("unexpected cache stats %+v", stats)
+	}
+
+	plex.SetDelay(0)
+	plex.SetFault(http.StatusServiceUnavailable, "")
+	gatherer.TTL = 0
+	sessions, errs := gatherer.GetAllSessions()
+	if len(sessions) != 1 || errs == "" {
+		t.Errorf("got %d sessions and %q from a failing server, want the stale session and an error", len(sessions), errs)
+	}
+	if servers := gatherer.Servers(); len(servers) != 1 || !servers[0].Stale || !errors.Is(servers[0].Err, ErrServerError) {
+		t.Errorf("expected stale Plex sessions, got %+v", servers)
+	}
+	if point := gatherer.Metrics(time.Now()); point.Fields["stale"] != 2 {
+		t.Errorf("unexpected cache metrics %+v", point.Fields)
+	}
+}
@@ -3,8 +3,7 @@ package jellyplexgatherer
 import (
 	"encoding/json"
 	"fmt"
-	"log"
-	"net/http"
+	"io"
 	"strings"
 	"time"
 )
@@ -19,21 +18,26 @@ func GetJellyActivityLogData(jellyfinAddress, jellyfinApiKey string, minutesSinc
 	url := fmt.Sprintf("%s/System/ActivityLog/Entries?minDate=%s&limit=%d&api_key=%s", jellyfinAddress, timeSinceIso, maxRecords, jellyfinApiKey)
 
 	// Make the GET request
-	resp, err := http.Get(url)
+	start := time.Now()
+	resp, err := HTTPClient.Get(url)
 	if err != nil {
 		return JellyActivityLog{}, err
 	}
 	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return JellyActivityLog{}, err
+	}
+	logResponse("jellyfin", jellyfinAddress, "/System/ActivityLog/Entries", resp.StatusCode, time.Since(start), body)
 
-	if resp.StatusCode != http.StatusOK {
-		return JellyActivityLog{}, fmt.Errorf("failed to fetch data: %s", resp.Status)
+	if err := checkResponse("jellyfin", "/System/ActivityLog/Entries", resp, body, "application/json"); err != nil {
+		return JellyActivityLog{}, err
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(&activityLog)
+	err = json.Unmarshal(body, &activityLog)
 	if err != nil {
 		return JellyActivityLog{}, fmt.Errorf("failed to decode response: %v", err)
 	}
-	log.Println("Jellyfin activity data scraped succesfully")
 	return activityLog, nil
 }
 
@@ -86,7 +90,7 @@ func GetOnlineUsers(jellyfinAddress, jellyfinApiKey string, maxRecords int32, mi
 	// Fetch activity log data from Jellyfin API
 	activityLog, err := GetJellyActivityLogData(jellyfinAddress, jellyfinApiKey, minutesSinceNow, maxRecords)
 	if err != nil {
-		log.Printf("Error fetching activity log: %v", err)
+		logger().Warn("fetching Jellyfin activity log failed", "backend", "jellyfin", "server", jellyfinAddress, "error", err)
 		return nil, err
 	}
 
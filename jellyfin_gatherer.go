@@ -4,37 +4,45 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
-	"net/http"
 	"strconv"
+	"time"
 )
 
 // Get Jellyfin data and parse it into a struct
 func GetJellyData(jellyfinAddress, jellyfinApiKey string) (sessions JellySessions, err error) {
 
 	url := fmt.Sprintf(jellyfinAddress + "/Sessions?api_key=" + jellyfinApiKey)
-	resp, err := http.Get(url)
+	start := time.Now()
+	resp, err := HTTPClient.Get(url)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	log.Printf("API request to Jellyfin at %s completed with status code: %d", jellyfinAddress, resp.StatusCode)
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
+	logResponse("jellyfin", jellyfinAddress, "/Sessions", resp.StatusCode, time.Since(start), body)
+	if err := checkResponse("jellyfin", "/Sessions", resp, body, "application/json"); err != nil {
+		return nil, err
+	}
 	err = json.Unmarshal(body, &sessions)
 	if err != nil {
 		return nil, err
 	}
-	log.Println("Jellyfin sessions scraped succesfully")
 	return sessions, nil
 }
 
 // Ingest Jellyfin data and assign metric per stream
 func GetJellySessions(jellyfinAddress, jellyfinApiKey string) (jellysessions []SessionData, err error) {
+	return GetJellySessionsWithOptions(jellyfinAddress, jellyfinApiKey, JellySessionOptions{})
+}
 
-	sessions, err := GetJellyData(jellyfinAddress, jellyfinApiKey)
+// GetJellySessions with the filtering done by Jellyfin, e.g. ActiveWithin to leave out
+// clients that are connected but haven't played anything for hours
+func GetJellySessionsWithOptions(jellyfinAddress, jellyfinApiKey string, opts JellySessionOptions) (jellysessions []SessionData, err error) {
+
+	sessions, err := getJellySessionSummaries(jellyfinAddress, jellyfinApiKey, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -43,13 +51,24 @@ func GetJellySessions(jellyfinAddress, jellyfinApiKey string) (jellysessions []S
 			continue
 		}
 		data := SessionData{
-			UserName:   session.UserName,
-			Name:       getJellyMediaName(session),
-			Bitrate:    getJellyStreamBitrate(session),
-			PlayMethod: session.PlayState.PlayMethod,
-			SubStream:  getJellySubstream(session),
-			DeviceName: session.DeviceName,
-			Service:    "Jellyfin",
+			UserName:     session.UserName,
+			UserID:       session.UserID,
+			Name:         getJellyMediaName(session),
+			Bitrate:      getJellyStreamBitrate(session),
+			PlayMethod:   session.PlayState.PlayMethod,
+			SubStream:    getJellySubstream(session),
+			DeviceName:   session.DeviceName,
+			Service:      "Jellyfin",
+			SessionID:    session.ID,
+			State:        getJellyState(session),
+			IPAddress:    session.RemoteEndPoint,
+			DeviceID:     session.DeviceID,
+			VideoHeight:  getJellyVideoHeight(session),
+			SourceHeight: getJellySourceHeight(session),
+			Location:     locationFromAddress(session.RemoteEndPoint),
+			Bandwidth:    getJellyBandwidth(session),
+			Media:        getJellyMediaRef(session),
+			Images:       getJellyImages(session),
 		}
 		jellysessions = append(jellysessions, data)
 	}
@@ -57,7 +76,7 @@ func GetJellySessions(jellyfinAddress, jellyfinApiKey string) (jellysessions []S
 }
 
 // There are two types of returned data, need to check and adjust where to look for substream accordingly
-func getJellySubstream(session JellySession) (substream string) {
+func getJellySubstream(session jellySessionSummary) (substream string) {
 	substream = "None"
 	if len(session.NowPlayingQueueFullItems) > 0 &&
 		session.PlayState.SubtitleStreamIndex > 0 &&
@@ -72,9 +91,10 @@ func getJellySubstream(session JellySession) (substream string) {
 }
 
 // There are two types of returned data, need to check and adjust where to look for bitrate accordingly
-func getJellyStreamBitrate(session JellySession) (bitrate string) {
+func getJellyStreamBitrate(session jellySessionSummary) (bitrate string) {
 	bitrate = "None"
 	if len(session.NowPlayingQueueFullItems) > 0 &&
+		len(session.NowPlayingQueueFullItems[0].MediaSources) > 0 &&
 		session.PlayState.PlayMethod != "" {
 		bitrate = strconv.FormatFloat(float64(session.NowPlayingQueueFullItems[0].MediaSources[0].Bitrate)/1000000.0, 'f', -1, 64)
 	}
@@ -92,7 +112,7 @@ func getJellyStreamBitrate(session JellySession) (bitrate string) {
 }
 
 // There are two types of returned data, need to check and adjust where to look for media name accordingly
-func getJellyMediaName(session JellySession) (name string) {
+func getJellyMediaName(session jellySessionSummary) (name string) {
 	name = "Not found"
 	name = session.NowPlayingItem.Name
 	if session.NowPlayingItem.SeriesName != "" {
@@ -101,7 +121,43 @@ func getJellyMediaName(session JellySession) (name string) {
 	return name
 }
 
+func getJellyState(session jellySessionSummary) string {
+	if session.PlayState.IsPaused {
+		return "paused"
+	}
+	return "playing"
+}
+
+// Transcodes are sent at the transcoder's bitrate, everything else at the media's
+func getJellyBandwidth(session jellySessionSummary) float64 {
+	if session.TranscodingInfo.Bitrate > 0 {
+		return float64(session.TranscodingInfo.Bitrate) / 1000000.0
+	}
+	bandwidth, _ := strconv.ParseFloat(getJellyStreamBitrate(session), 64)
+	return bandwidth
+}
+
+// Transcodes report the output size, direct streams only have the item's size
+func getJellyVideoHeight(session jellySessionSummary) int {
+	if session.TranscodingInfo.Height > 0 {
+		return session.TranscodingInfo.Height
+	}
+	return getJellySourceHeight(session)
+}
+
+func getJellySourceHeight(session jellySessionSummary) int {
+	if session.NowPlayingItem.Height > 0 {
+		return session.NowPlayingItem.Height
+	}
+	for _, stream := range session.NowPlayingItem.MediaStreams {
+		if stream.Type == "Video" {
+			return stream.Height
+		}
+	}
+	return 0
+}
+
 // Jellyfin returns not only playback sessions, also quasi empty 'device is active' sessions. Need to account for that. Silly, I know.
-func isJellyStream(session JellySession) bool {
+func isJellyStream(session jellySessionSummary) bool {
 	return session.PlayState.PositionTicks > 0
 }
@@ -0,0 +1,164 @@
+package jellyplexgatherer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// jellySessionSummary is the part of a /Sessions entry that SessionData is built from.
+// JellySession mirrors the whole payload, decoding into this instead skips the device
+// profiles, people, chapters and queued items that make up most of the response.
+type jellySessionSummary struct {
+	ID                  string `json:"Id"`
+	UserID              string `json:"UserId"`
+	UserName            string `json:"UserName"`
+	UserPrimaryImageTag string `json:"UserPrimaryImageTag"`
+	Client              string `json:"Client"`
+	DeviceName          string `json:"DeviceName"`
+	DeviceID            string `json:"DeviceId"`
+	RemoteEndPoint      string `json:"RemoteEndPoint"`
+	PlayState           struct {
+		PositionTicks       int    `json:"PositionTicks"`
+		IsPaused            bool   `json:"IsPaused"`
+		SubtitleStreamIndex int    `json:"SubtitleStreamIndex"`
+		PlayMethod          string `json:"PlayMethod"`
+	} `json:"PlayState"`
+	NowPlayingItem     jellyNowPlayingSummary `json:"NowPlayingItem"`
+	FullNowPlayingItem struct {
+		Container string `json:"Container"`
+	} `json:"FullNowPlayingItem"`
+	TranscodingInfo struct {
+		Bitrate int `json:"Bitrate"`
+		Height  int `json:"Height"`
+	} `json:"TranscodingInfo"`
+	NowPlayingQueueFullItems []struct {
+		MediaStreams []jellyStreamSummary `json:"MediaStreams"`
+		MediaSources []struct {
+			Bitrate int `json:"Bitrate"`
+		} `json:"MediaSources"`
+	} `json:"NowPlayingQueueFullItems"`
+	Capabilities struct {
+		SupportedCommands []string `json:"SupportedCommands"`
+	} `json:"Capabilities"`
+	SupportedCommands []string `json:"SupportedCommands"`
+}
+
+type jellyNowPlayingSummary struct {
+	ID                      string               `json:"Id"`
+	Name                    string               `json:"Name"`
+	Type                    string               `json:"Type"`
+	SeriesName              string               `json:"SeriesName"`
+	SeriesID                string               `json:"SeriesId"`
+	SeriesPrimaryImageTag   string               `json:"SeriesPrimaryImageTag"`
+	SeasonName              string               `json:"SeasonName"`
+	IndexNumber             int                  `json:"IndexNumber"`
+	ParentIndexNumber       int                  `json:"ParentIndexNumber"`
+	ProductionYear          int                  `json:"ProductionYear"`
+	ProviderIds             map[string]string    `json:"ProviderIds"`
+	AlbumID                 string               `json:"AlbumId"`
+	AlbumPrimaryImageTag    string               `json:"AlbumPrimaryImageTag"`
+	AlbumArtist             string               `json:"AlbumArtist"`
+	ImageTags               map[string]string    `json:"ImageTags"`
+	BackdropImageTags       []string             `json:"BackdropImageTags"`
+	ParentBackdropItemID    string               `json:"ParentBackdropItemId"`
+	ParentBackdropImageTags []string             `json:"ParentBackdropImageTags"`
+	Height                  int                  `json:"Height"`
+	MediaStreams            []jellyStreamSummary `json:"MediaStreams"`
+}
+
+type jellyStreamSummary struct {
+	Type         string `json:"Type"`
+	DisplayTitle string `json:"DisplayTitle"`
+	BitRate      int    `json:"BitRate"`
+	Height       int    `json:"Height"`
+}
+
+// JellySessionOptions narrows down what /Sessions returns. The zero value fetches every
+// session, including the idle "device is active" ones that GetJellySessions drops anyway.
+type JellySessionOptions struct {
+	ActiveWithin         time.Duration // only sessions active this recently, rounded up to seconds
+	ControllableByUserID string        // only sessions this user can control
+	DeviceID             string        // only the sessions of this device
+
+	// Don't decode NowPlayingQueueFullItems. Jellyfin has no parameter to leave them out of
+	// the response, but they are the bulk of it. Bitrate and subtitle then only come from
+	// NowPlayingItem, which some clients leave incomplete.
+	SkipQueueItems bool
+}
+
+// The /Sessions url with the filters as query parameters
+func jellySessionsURL(jellyfinAddress, jellyfinApiKey string, opts JellySessionOptions) string {
+	query := url.Values{"api_key": {jellyfinApiKey}}
+	if opts.ActiveWithin > 0 {
+		seconds := (opts.ActiveWithin + time.Second - 1) / time.Second
+		query.Set("activeWithinSeconds", strconv.FormatInt(int64(seconds), 10))
+	}
+	if opts.ControllableByUserID != "" {
+		query.Set("controllableByUserId", opts.ControllableByUserID)
+	}
+	if opts.DeviceID != "" {
+		query.Set("deviceId", opts.DeviceID)
+	}
+	return jellyfinAddress + "/Sessions?" + query.Encode()
+}
+
+// Fetch /Sessions and decode the summaries straight from the response body. The body is
+// only buffered when payload logging needs it.
+func getJellySessionSummaries(jellyfinAddress, jellyfinApiKey string, opts JellySessionOptions) ([]jellySessionSummary, error) {
+	start := time.Now()
+	resp, err := HTTPClient.Get(jellySessionsURL(jellyfinAddress, jellyfinApiKey, opts))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse("jellyfin", "/Sessions", resp, nil, "application/json"); err != nil {
+		logResponse("jellyfin", jellyfinAddress, "/Sessions", resp.StatusCode, time.Since(start), nil)
+		return nil, err
+	}
+
+	var body io.Reader = resp.Body
+	var payload []byte
+	if logPayloads.Load() {
+		if payload, err = io.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(payload)
+	}
+	sessions, err := decodeJellySessionSummaries(body, opts.SkipQueueItems)
+	logResponse("jellyfin", jellyfinAddress, "/Sessions", resp.StatusCode, time.Since(start), payload)
+	return sessions, err
+}
+
+func decodeJellySessionSummaries(r io.Reader, skipQueueItems bool) (sessions []jellySessionSummary, err error) {
+	if !skipQueueItems {
+		err = json.NewDecoder(r).Decode(&sessions)
+		return sessions, err
+	}
+	// Decode element by element so only the summaries are kept
+	decoder := json.NewDecoder(r)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return nil, errors.Join(errors.New("jellyfin sessions are not a list"), err)
+	}
+	for decoder.More() {
+		var session struct {
+			jellySessionSummary
+			NowPlayingQueueFullItems skipJSON `json:"NowPlayingQueueFullItems"`
+		}
+		if err = decoder.Decode(&session); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session.jellySessionSummary)
+	}
+	_, err = decoder.Token()
+	return sessions, err
+}
+
+// skipJSON shadows a field so the decoder scans over it without allocating anything
+type skipJSON struct{}
+
+func (*skipJSON) UnmarshalJSON([]byte) error { return nil }
@@ -0,0 +1,382 @@
+package jellyplexgatherer
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LibraryStats are the normalized counts of one library on either server
+type LibraryStats struct {
+	Service       string
+	ID            string
+	Name          string
+	Type          string // movie, show, music or whatever else the server calls it
+	Movies        int
+	Shows         int
+	Episodes      int
+	Albums        int
+	Tracks        int
+	TotalSize     int64 // bytes, only filled when LibraryOptions.IncludeSize is set
+	RecentlyAdded []LibraryItem
+}
+
+// LibraryItem is a single movie, episode or track
+type LibraryItem struct {
+	Service     string
+	LibraryName string
+	ID          string
+	Type        string // movie, episode or track
+	Title       string
+	SeriesTitle string // show for episodes, artist for tracks
+	Season      int
+	Episode     int
+	Year        int
+	AddedAt     time.Time
+	ProviderIDs map[string]string // imdb, tmdb, tvdb
+}
+
+type LibraryOptions struct {
+	IncludeSize bool // sums media file sizes, needs to list every item so it's slow on big libraries
+	RecentLimit int  // recently added items per library, 0 skips them
+}
+
+// GET a url and decode the JSON body, backend names the service in errors
+func getJSON(backend, url string, v interface{}) error {
+	resp, err := HTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(backend, endpointPath(url), resp, nil, "application/json"); err != nil {
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
+
+// GET a url and decode the XML body, backend names the service in errors ("plex" or "plex.tv")
+func getXML(backend, url string, v interface{}) error {
+	resp, err := HTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(backend, endpointPath(url), resp, nil, "application/xml", "text/xml"); err != nil {
+		return err
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
+
+type plexSections struct {
+	Directory []struct {
+		Key   string `xml:"key,attr"`
+		Type  string `xml:"type,attr"`
+		Title string `xml:"title,attr"`
+	} `xml:"Directory"`
+}
+
+type plexLibraryItems struct {
+	TotalSize string            `xml:"totalSize,attr"`
+	Items     []plexLibraryItem `xml:",any"`
+}
+
+type plexLibraryItem struct {
+	RatingKey        string `xml:"ratingKey,attr"`
+	Type             string `xml:"type,attr"`
+	Title            string `xml:"title,attr"`
+	GrandparentTitle string `xml:"grandparentTitle,attr"`
+	ParentIndex      string `xml:"parentIndex,attr"`
+	Index            string `xml:"index,attr"`
+	Year             string `xml:"year,attr"`
+	AddedAt          string `xml:"addedAt,attr"`
+	Guid             string `xml:"guid,attr"`
+	Guids            []struct {
+		ID string `xml:"id,attr"`
+	} `xml:"Guid"`
+	Media []struct {
+		Part []struct {
+			Size string `xml:"size,attr"`
+		} `xml:"Part"`
+	} `xml:"Media"`
+}
+
+// Plex metadata type numbers used by the type= filter
+var plexTypeNumbers = map[string]string{"movie": "1", "show": "2", "episode": "4", "album": "9", "track": "10"}
+
+// Get per library stats from Plex /library/sections
+func GetPlexLibraryStats(plexAddress, plexApiKey string, opts LibraryOptions) (stats []LibraryStats, err error) {
+	var sections plexSections
+	if err := getXML("plex", plexAddress+"/library/sections?X-Plex-Token="+plexApiKey, &sections); err != nil {
+		return nil, err
+	}
+	for _, section := range sections.Directory {
+		library := LibraryStats{Service: "Plex", ID: section.Key, Name: section.Title, Type: section.Type}
+		counts := map[string]*int{"movie": &library.Movies, "show": &library.Shows, "episode": &library.Episodes, "album": &library.Albums, "track": &library.Tracks}
+		var countTypes []string
+		switch section.Type {
+		case "movie":
+			countTypes = []string{"movie"}
+		case "show":
+			countTypes = []string{"show", "episode"}
+		case "artist":
+			library.Type = "music"
+			countTypes = []string{"album", "track"}
+		}
+		for _, itemType := range countTypes {
+			var container plexLibraryItems
+			endpoint := fmt.Sprintf("%s/library/sections/%s/all?type=%s&X-Plex-Container-Start=0&X-Plex-Container-Size=0&X-Plex-Token=%s", plexAddress, section.Key, plexTypeNumbers[itemType], plexApiKey)
+			if err := getXML("plex", endpoint, &container); err != nil {
+				return nil, fmt.Errorf("counting %ss in plex library %s: %w", itemType, section.Title, err)
+			}
+			*counts[itemType], _ = strconv.Atoi(container.TotalSize)
+		}
+		if opts.IncludeSize && len(countTypes) > 0 {
+			// Files hang off the leaf type: movies, episodes or tracks
+			var container plexLibraryItems
+			leaf := plexTypeNumbers[countTypes[len(countTypes)-1]]
+			endpoint := fmt.Sprintf("%s/library/sections/%s/all?type=%s&X-Plex-Token=%s", plexAddress, section.Key, leaf, plexApiKey)
+			if err := getXML("plex", endpoint, &container); err != nil {
+				return nil, fmt.Errorf("sizing plex library %s: %w", section.Title, err)
+			}
+			for _, item := range container.Items {
+				for _, media := range item.Media {
+					for _, part := range media.Part {
+						size, _ := strconv.ParseInt(part.Size, 10, 64)
+						library.TotalSize += size
+					}
+				}
+			}
+		}
+		if opts.RecentLimit > 0 {
+			library.RecentlyAdded, err = getPlexRecentlyAdded(plexAddress, plexApiKey, section.Key, section.Title, opts.RecentLimit)
+			if err != nil {
+				return nil, err
+			}
+		}
+		stats = append(stats, library)
+	}
+	return stats, nil
+}
+
+func getPlexRecentlyAdded(plexAddress, plexApiKey, sectionKey, sectionTitle string, limit int) (items []LibraryItem, err error) {
+	var container plexLibraryItems
+	endpoint := fmt.Sprintf("%s/library/sections/%s/recentlyAdded?includeGuids=1&X-Plex-Container-Start=0&X-Plex-Container-Size=%d&X-Plex-Token=%s", plexAddress, sectionKey, limit, plexApiKey)
+	if err := getXML("plex", endpoint, &container); err != nil {
+		return nil, fmt.Errorf("fetching recently added in plex library %s: %w", sectionTitle, err)
+	}
+	for _, item := range container.Items {
+		items = append(items, plexLibraryItemData(item, sectionTitle))
+	}
+	return items, nil
+}
+
+func plexLibraryItemData(item plexLibraryItem, libraryName string) LibraryItem {
+	data := LibraryItem{
+		Service:     "Plex",
+		LibraryName: libraryName,
+		ID:          item.RatingKey,
+		Type:        item.Type,
+		Title:       item.Title,
+		SeriesTitle: item.GrandparentTitle,
+		ProviderIDs: plexProviderIDs(item.Guid),
+	}
+	for _, guid := range item.Guids {
+		for provider, id := range plexProviderIDs(guid.ID) {
+			data.ProviderIDs[provider] = id
+		}
+	}
+	data.Season, _ = strconv.Atoi(item.ParentIndex)
+	data.Episode, _ = strconv.Atoi(item.Index)
+	data.Year, _ = strconv.Atoi(item.Year)
+	if addedAt, err := strconv.ParseInt(item.AddedAt, 10, 64); err == nil {
+		data.AddedAt = time.Unix(addedAt, 0)
+	}
+	return data
+}
+
+type jellyVirtualFolder struct {
+	Name           string `json:"Name"`
+	ItemID         string `json:"ItemId"`
+	CollectionType string `json:"CollectionType"`
+}
+
+type jellyItems struct {
+	Items            []jellyItem `json:"Items"`
+	TotalRecordCount int         `json:"TotalRecordCount"`
+}
+
+type jellyItem struct {
+	Name              string            `json:"Name"`
+	ID                string            `json:"Id"`
+	Type              string            `json:"Type"`
+	SeriesName        string            `json:"SeriesName"`
+	AlbumArtist       string            `json:"AlbumArtist"`
+	ParentIndexNumber int               `json:"ParentIndexNumber"`
+	IndexNumber       int               `json:"IndexNumber"`
+	ProductionYear    int               `json:"ProductionYear"`
+	DateCreated       time.Time         `json:"DateCreated"`
+	ProviderIds       map[string]string `json:"ProviderIds"`
+	MediaSources      []struct {
+		Size int64 `json:"Size"`
+	} `json:"MediaSources"`
+}
+
+// Jellyfin item type -> normalized LibraryItem type
+var jellyItemTypes = map[string]string{"Movie": "movie", "Series": "show", "Episode": "episode", "MusicAlbum": "album", "Audio": "track"}
+
+// Get per library stats from Jellyfin /Library/VirtualFolders and /Items. /Items/Counts can't
+// be narrowed to a library, so every type is counted with a Limit=0 /Items query instead.
+func GetJellyLibraryStats(jellyfinAddress, jellyfinApiKey string, opts LibraryOptions) (stats []LibraryStats, err error) {
+	var folders []jellyVirtualFolder
+	if err := getJSON("jellyfin", jellyfinAddress+"/Library/VirtualFolders?api_key="+jellyfinApiKey, &folders); err != nil {
+		return nil, err
+	}
+	for _, folder := range folders {
+		library := LibraryStats{Service: "Jellyfin", ID: folder.ItemID, Name: folder.Name, Type: folder.CollectionType}
+		counts := map[string]*int{"Movie": &library.Movies, "Series": &library.Shows, "Episode": &library.Episodes, "MusicAlbum": &library.Albums, "Audio": &library.Tracks}
+		var countTypes []string
+		switch folder.CollectionType {
+		case "movies":
+			library.Type = "movie"
+			countTypes = []string{"Movie"}
+		case "tvshows":
+			library.Type = "show"
+			countTypes = []string{"Series", "Episode"}
+		case "music":
+			countTypes = []string{"MusicAlbum", "Audio"}
+		}
+		for _, itemType := range countTypes {
+			items, err := getJellyItems(jellyfinAddress, jellyfinApiKey, folder.ItemID, url.Values{"IncludeItemTypes": {itemType}, "Limit": {"0"}})
+			if err != nil {
+				return nil, fmt.Errorf("counting %s in jellyfin library %s: %w", itemType, folder.Name, err)
+			}
+			*counts[itemType] = items.TotalRecordCount
+		}
+		if opts.IncludeSize && len(countTypes) > 0 {
+			items, err := getJellyItems(jellyfinAddress, jellyfinApiKey, folder.ItemID, url.Values{"IncludeItemTypes": {countTypes[len(countTypes)-1]}, "Fields": {"MediaSources"}})
+			if err != nil {
+				return nil, fmt.Errorf("sizing jellyfin library %s: %w", folder.Name, err)
+			}
+			for _, item := range items.Items {
+				if len(item.MediaSources) > 0 {
+					library.TotalSize += item.MediaSources[0].Size
+				}
+			}
+		}
+		if opts.RecentLimit > 0 {
+			library.RecentlyAdded, err = getJellyRecentlyAdded(jellyfinAddress, jellyfinApiKey, folder.ItemID, folder.Name, opts.RecentLimit)
+			if err != nil {
+				return nil, err
+			}
+		}
+		stats = append(stats, library)
+	}
+	return stats, nil
+}
+
+func getJellyItems(jellyfinAddress, jellyfinApiKey, parentID string, query url.Values) (items jellyItems, err error) {
+	if parentID != "" {
+		query.Set("ParentId", parentID)
+	}
+	query.Set("Recursive", "true")
+	query.Set("api_key", jellyfinApiKey)
+	err = getJSON("jellyfin", jellyfinAddress+"/Items?"+query.Encode(), &items)
+	return items, err
+}
+
+func getJellyRecentlyAdded(jellyfinAddress, jellyfinApiKey, parentID, libraryName string, limit int) (items []LibraryItem, err error) {
+	query := url.Values{
+		"SortBy":           {"DateCreated"},
+		"SortOrder":        {"Descending"},
+		"IncludeItemTypes": {"Movie,Episode,Audio"},
+		"Fields":           {"DateCreated,ProviderIds"},
+	}
+	if limit > 0 {
+		query.Set("Limit", strconv.Itoa(limit))
+	}
+	result, err := getJellyItems(jellyfinAddress, jellyfinApiKey, parentID, query)
+	if err != nil {
+		return nil, fmt.Errorf("fetching recently added in jellyfin library %s: %w", libraryName, err)
+	}
+	for _, item := range result.Items {
+		items = append(items, jellyLibraryItemData(item, libraryName))
+	}
+	return items, nil
+}
+
+func jellyLibraryItemData(item jellyItem, libraryName string) LibraryItem {
+	data := LibraryItem{
+		Service:     "Jellyfin",
+		LibraryName: libraryName,
+		ID:          item.ID,
+		Type:        jellyItemTypes[item.Type],
+		Title:       item.Name,
+		SeriesTitle: item.SeriesName,
+		Season:      item.ParentIndexNumber,
+		Episode:     item.IndexNumber,
+		Year:        item.ProductionYear,
+		AddedAt:     item.DateCreated,
+		ProviderIDs: jellyProviderIDs(item.ProviderIds),
+	}
+	if data.Type == "" {
+		data.Type = strings.ToLower(item.Type)
+	}
+	if item.Type == "Audio" {
+		data.SeriesTitle = item.AlbumArtist
+	}
+	return data
+}
+
+// Get library stats from every configured server, same address/key convention as GetAllSessions
+func GetAllLibraryStats(jellyfinAddress, jellyfinApiKey, plexAddress, plexApiKey string, opts LibraryOptions) (allStats []LibraryStats, errors string) {
+	if jellyfinAddress != "" || jellyfinApiKey != "" {
+		stats, err := GetJellyLibraryStats(jellyfinAddress, jellyfinApiKey, opts)
+		if err != nil {
+			errors = fmt.Sprintf("Error getting Jellyfin library stats: %s", err)
+		}
+		allStats = append(allStats, stats...)
+	}
+	if plexAddress != "" || plexApiKey != "" {
+		stats, err := GetPlexLibraryStats(plexAddress, plexApiKey, opts)
+		if err != nil {
+			errors = errors + "\n" + fmt.Sprintf("Error getting Plex library stats: %s", err)
+		}
+		allStats = append(allStats, stats...)
+	}
+	return allStats, errors
+}
+
+// LibraryMetrics turns library stats into "library" points for the metric exporters
+func LibraryMetrics(stats []LibraryStats, now time.Time) []MetricPoint {
+	points := make([]MetricPoint, 0, len(stats))
+	for _, library := range stats {
+		fields := map[string]float64{
+			"movies":         float64(library.Movies),
+			"shows":          float64(library.Shows),
+			"episodes":       float64(library.Episodes),
+			"albums":         float64(library.Albums),
+			"tracks":         float64(library.Tracks),
+			"recently_added": float64(len(library.RecentlyAdded)),
+		}
+		if library.TotalSize > 0 {
+			fields["size_bytes"] = float64(library.TotalSize)
+		}
+		points = append(points, MetricPoint{
+			Name:   "library",
+			Tags:   map[string]string{"service": library.Service, "library": library.Name, "type": library.Type},
+			Fields: fields,
+			Time:   now,
+		})
+	}
+	return points
+}
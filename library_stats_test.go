@@ -0,0 +1,130 @@
+package jellyplexgatherer
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetJellyLibraryStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		query := r.URL.Query()
+		switch {
+		case r.URL.Path == "/Library/VirtualFolders":
+			w.Write([]byte(`[{"Name":"Shows","ItemId":"f1","CollectionType":"tvshows"},{"Name":"Photos","ItemId":"f2","CollectionType":"homevideos"}]`))
+		case query.Get("ParentId") == "f2":
+			// Only recently added is fetched for libraries of other types
+			w.Write([]byte(`{"Items":[]}`))
+		case query.Get("Limit") == "0":
+			counts := map[string]string{"Series": "2", "Episode": "30"}
+			w.Write([]byte(`{"Items":[],"TotalRecordCount":` + counts[query.Get("IncludeItemTypes")] + `}`))
+		case query.Get("Fields") == "MediaSources":
+			w.Write([]byte(`{"Items":[{"MediaSources":[{"Size":1000}]},{"MediaSources":[]},{"MediaSources":[{"Size":24}]}]}`))
+		default:
+			w.Write([]byte(`{"Items":[{"Id":"e1","Name":"Pilot","Type":"Episode","SeriesName":"Twin Peaks","ParentIndexNumber":1,"IndexNumber":1,"ProviderIds":{"Tvdb":"4"},"DateCreated":"2024-03-01T20:00:00Z"}]}`))
+		}
+	}))
+	defer server.Close()
+
+	stats, err := GetJellyLibraryStats(server.URL, "jellykey", LibraryOptions{IncludeSize: true, RecentLimit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("got %d libraries, want 2", len(stats))
+	}
+	shows := stats[0]
+	if shows.Type != "show" || shows.Shows != 2 || shows.Episodes != 30 || shows.TotalSize != 1024 {
+		t.Errorf("unexpected stats %+v", shows)
+	}
+	want := []LibraryItem{{
+		Service: "Jellyfin", LibraryName: "Shows", ID: "e1", Type: "episode", Title: "Pilot", SeriesTitle: "Twin Peaks",
+		Season: 1, Episode: 1, AddedAt: time.Date(2024, 3, 1, 20, 0, 0, 0, time.UTC), ProviderIDs: map[string]string{"tvdb": "4"},
+	}}
+	if !reflect.DeepEqual(shows.RecentlyAdded, want) {
+		t.Errorf("got recently added %+v, want %+v", shows.RecentlyAdded, want)
+	}
+	if stats[1].Type != "homevideos" || stats[1].TotalSize != 0 {
+		t.Errorf("unexpected stats for an uncounted library %+v", stats[1])
+	}
+
+	points := LibraryMetrics(stats, time.Unix(0, 0))
+	if len(points) != 2 || points[0].Fields["episodes"] != 30 || points[0].Tags["library"] != "Shows" {
+		t.Errorf("unexpected metrics %+v", points)
+	}
+}
+
+func TestGetPlexLibraryStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		switch r.URL.Path {
+		case "/library/sections":
+			w.Write([]byte(`<MediaContainer><Directory key="3" type="artist" title="Music"/></MediaContainer>`))
+		case "/library/sections/3/all":
+			switch {
+			case r.URL.Query().Get("X-Plex-Container-Size") == "0":
+				totals := map[string]string{"9": "4", "10": "52"}
+				w.Write([]byte(`<MediaContainer totalSize="` + totals[r.URL.Query().Get("type")] + `"/>`))
+			default:
+				w.Write([]byte(`<MediaContainer><Track><Media><Part size="100"/><Part size="20"/></Media></Track><Track><Media><Part size="3"/></Media></Track></MediaContainer>`))
+			}
+		case "/library/sections/3/recentlyAdded":
+			w.Write([]byte(`<MediaContainer><Track ratingKey="7" type="track" title="Teardrop" grandparentTitle="Massive Attack" parentIndex="1" index="3" addedAt="1700000000"/></MediaContainer>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	stats, err := GetPlexLibraryStats(server.URL, "plextoken", LibraryOptions{IncludeSize: true, RecentLimit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("got %d libraries, want 1", len(stats))
+	}
+	music := stats[0]
+	if music.Type != "music" || music.Albums != 4 || music.Tracks != 52 || music.TotalSize != 123 {
+		t.Errorf("unexpected stats %+v", music)
+	}
+	if len(music.RecentlyAdded) != 1 || music.RecentlyAdded[0].SeriesTitle != "Massive Attack" || !music.RecentlyAdded[0].AddedAt.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("unexpected recently added %+v", music.RecentlyAdded)
+	}
+}
+
+func TestGetXMLNamesService(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	var v struct{}
+	err := getXML("plex.tv", server.URL+"/api/users?X-Plex-Token=secret", &v)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Backend != "plex.tv" || statusErr.Endpoint != "/api/users" {
+		t.Errorf("got %v, want a plex.tv StatusError", err)
+	}
+}
+
+func TestLibraryStatsKeepErrorChain(t *testing.T) {
+	// Listing works but counting is refused, as with a token limited to some libraries
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/library/sections" {
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(`<MediaContainer><Directory key="1" type="movie" title="Movies"/></MediaContainer>`))
+			return
+		}
+		http.Error(w, "", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	_, err := GetPlexLibraryStats(server.URL, "plextoken", LibraryOptions{})
+	var statusErr *StatusError
+	if !errors.Is(err, ErrUnauthorized) || !errors.As(err, &statusErr) || statusErr.Endpoint != "/library/sections/1/all" {
+		t.Errorf("got %v, want an unauthorized StatusError for the counting endpoint", err)
+	}
+}
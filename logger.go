@@ -0,0 +1,61 @@
+package jellyplexgatherer
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	packageLogger atomic.Pointer[slog.Logger]
+	logPayloads   atomic.Bool
+	discardLogger = slog.New(discardHandler{})
+)
+
+// SetLogger sends the package's logs to l, nil silences them again, which is the default.
+// Requests are logged at debug level with server, backend, status and duration attributes,
+// failures in background loops (watcher, notifier, exporters) at warn and error level.
+func SetLogger(l *slog.Logger) {
+	packageLogger.Store(l)
+}
+
+// SetPayloadLogging adds the raw response bodies of session and activity requests to the
+// debug logs. They contain user names and addresses, only enable it while debugging.
+func SetPayloadLogging(enabled bool) {
+	logPayloads.Store(enabled)
+}
+
+func logger() *slog.Logger {
+	if l := packageLogger.Load(); l != nil {
+		return l
+	}
+	return discardLogger
+}
+
+// Log a finished request to a media server, with the body if payload logging is on
+func logResponse(backend, server, endpoint string, status int, duration time.Duration, body []byte) {
+	l := logger()
+	if !l.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	attrs := []any{
+		slog.String("backend", backend),
+		slog.String("server", server),
+		slog.String("endpoint", endpoint),
+		slog.Int("status", status),
+		slog.Duration("duration", duration),
+	}
+	if logPayloads.Load() && body != nil {
+		attrs = append(attrs, slog.String("payload", string(body)))
+	}
+	l.Debug("media server request completed", attrs...)
+}
+
+// slog has no discard handler before Go 1.24
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
@@ -0,0 +1,113 @@
+package jellyplexgatherer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MediaRef identifies what a session is playing in a structured, server independent way,
+// so history and stats can aggregate the same title across Plex and Jellyfin
+type MediaRef struct {
+	Type        string // movie, episode or track
+	Title       string
+	Series      string // show for episodes, artist for tracks
+	Season      int
+	Episode     int
+	Year        int
+	ProviderIDs map[string]string // imdb, tmdb, tvdb
+}
+
+// Key is a stable identity for the title: the id of the first known provider in IMDb, TMDb,
+// TVDb order, then a normalized title (series, year, season and episode for episodes)
+func (r MediaRef) Key() string {
+	if keys := providerMatchKeys(r.Type, r.ProviderIDs); len(keys) > 0 {
+		return keys[0]
+	}
+	return titleMatchKey(r.libraryItem())
+}
+
+// Matches reports whether both refs point to the same title. Provider ids both refs have must
+// all agree, the title key is only compared when neither has any.
+func (r MediaRef) Matches(other MediaRef) bool {
+	shared := false
+	for _, provider := range providerPrecedence {
+		id, ok := r.ProviderIDs[provider]
+		otherID, otherOK := other.ProviderIDs[provider]
+		// TMDb and TVDb numbers are only unique within a type
+		if !ok || !otherOK || provider != ProviderIMDb && r.Type != other.Type {
+			continue
+		}
+		if id != otherID {
+			return false
+		}
+		shared = true
+	}
+	if shared {
+		return true
+	}
+	if len(providerMatchKeys(r.Type, r.ProviderIDs)) > 0 || len(providerMatchKeys(other.Type, other.ProviderIDs)) > 0 {
+		return false
+	}
+	return r.Type == other.Type && titleMatchKey(r.libraryItem()) == titleMatchKey(other.libraryItem())
+}
+
+func (r MediaRef) libraryItem() LibraryItem {
+	return LibraryItem{Type: r.Type, Title: r.Title, SeriesTitle: r.Series, Season: r.Season, Episode: r.Episode, Year: r.Year}
+}
+
+func (item LibraryItem) mediaRef() MediaRef {
+	return MediaRef{Type: item.Type, Title: item.Title, Series: item.SeriesTitle, Season: item.Season, Episode: item.Episode, Year: item.Year, ProviderIDs: item.ProviderIDs}
+}
+
+func (r MediaRef) String() string {
+	if r.Type == "episode" {
+		return fmt.Sprintf("%s S%02dE%02d - %s", r.Series, r.Season, r.Episode, r.Title)
+	}
+	if r.Year > 0 {
+		return fmt.Sprintf("%s (%d)", r.Title, r.Year)
+	}
+	return r.Title
+}
+
+func getPlexMediaRef(session PlexVideoSession) MediaRef {
+	ref := MediaRef{
+		Type:        session.Type,
+		Title:       session.Title,
+		Series:      session.GrandparentTitle,
+		ProviderIDs: plexProviderIDs(session.Guid),
+	}
+	for _, guid := range session.Guids {
+		for provider, id := range plexProviderIDs(guid.ID) {
+			ref.ProviderIDs[provider] = id
+		}
+	}
+	ref.Season, _ = strconv.Atoi(session.ParentIndex)
+	ref.Episode, _ = strconv.Atoi(session.Index)
+	ref.Year, _ = strconv.Atoi(session.Year)
+	if ref.Type == "track" {
+		// Tracks carry their album's year
+		ref.Year, _ = strconv.Atoi(session.ParentYear)
+	}
+	return ref
+}
+
+func getJellyMediaRef(session jellySessionSummary) MediaRef {
+	item := session.NowPlayingItem
+	ref := MediaRef{
+		Type:        jellyItemTypes[item.Type],
+		Title:       item.Name,
+		Series:      item.SeriesName,
+		Season:      item.ParentIndexNumber,
+		Episode:     item.IndexNumber,
+		Year:        item.ProductionYear,
+		ProviderIDs: jellyProviderIDs(item.ProviderIds),
+	}
+	if ref.Type == "" {
+		ref.Type = strings.ToLower(item.Type)
+	}
+	if item.Type == "Audio" {
+		ref.Series = item.AlbumArtist
+	}
+	return ref
+}
@@ -0,0 +1,40 @@
+package jellyplexgatherer
+
+import "testing"
+
+func TestMediaRefMatches(t *testing.T) {
+	heat := MediaRef{Type: "movie", Title: "Heat", Year: 1995, ProviderIDs: map[string]string{"imdb": "tt0113277", "tmdb": "949"}}
+	tests := []struct {
+		other MediaRef
+		want  bool
+	}{
+		{MediaRef{Type: "movie", Title: "Heat", Year: 1995, ProviderIDs: map[string]string{"tmdb": "949", "tvdb": "1"}}, true},
+		{MediaRef{Type: "movie", Title: "Heat", Year: 1995, ProviderIDs: map[string]string{"imdb": "tt0113277", "tmdb": "1"}}, false},
+		{MediaRef{Type: "show", Title: "Heat", ProviderIDs: map[string]string{"tmdb": "949"}}, false},
+		{MediaRef{Type: "movie", Title: "Heat", Year: 1995}, false},
+	}
+	for _, test := range tests {
+		if got := heat.Matches(test.other); got != test.want {
+			t.Errorf("Matches(%+v) = %v, want %v", test.other, got, test.want)
+		}
+	}
+
+	uk := MediaRef{Type: "episode", Title: "Downsize", Series: "The Office", Season: 1, Episode: 1, Year: 2001}
+	us := MediaRef{Type: "episode", Title: "Pilot", Series: "The Office", Season: 1, Episode: 1, Year: 2005}
+	if uk.Matches(us) || !us.Matches(MediaRef{Type: "episode", Title: "Pilot", Series: "the office", Season: 1, Episode: 1, Year: 2005}) {
+		t.Error("episodes without ids matched on the wrong key")
+	}
+}
+
+func TestMediaRefKey(t *testing.T) {
+	// The same precedence whatever the map order
+	for i := 0; i < 20; i++ {
+		ref := MediaRef{Type: "episode", ProviderIDs: map[string]string{"tvdb": "4", "tmdb": "1340623", "imdb": "tt0789012"}}
+		if key := ref.Key(); key != "imdb:tt0789012" {
+			t.Fatalf("got key %s", key)
+		}
+	}
+	if key := (MediaRef{Type: "episode", ProviderIDs: map[string]string{"tvdb": "4", "tmdb": "7"}}).Key(); key != "tmdb:episode:7" {
+		t.Errorf("got key %s, want tmdb before tvdb", key)
+	}
+}
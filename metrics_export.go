@@ -0,0 +1,343 @@
+package jellyplexgatherer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// MetricPoint is the one metric model all exporters serialize. Session points are built by
+// reflecting over SessionData, so new fields show up everywhere without touching the exporters:
+// numeric and bool fields become values. Only the low cardinality strings in sessionMetricTags
+// become tags, ids, addresses and titles would create a series per stream and put personal
+// data into tag indexes. Tag a field `metric:"-"` to skip it.
+type MetricPoint struct {
+	Name   string
+	Tags   map[string]string
+	Fields map[string]float64
+	Time   time.Time
+}
+
+type MetricExporter interface {
+	Export(points []MetricPoint) error
+}
+
+// String fields of SessionData that really hold numbers
+var numericSessionFields = map[string]bool{"Bitrate": true}
+
+// String fields of SessionData, by metric name, that are exported as tags
+var sessionMetricTags = map[string]bool{"service": true, "user_name": true, "play_method": true}
+
+// SessionMetrics turns a snapshot into one "session" point per stream and one "server" aggregate per service
+func SessionMetrics(sessions []SessionData, now time.Time) []MetricPoint {
+	points := make([]MetricPoint, 0, len(sessions)+2)
+	transcodes := make(map[string]int)
+	for _, session := range sessions {
+		points = append(points, sessionMetricPoint(session, now))
+		if session.IsTranscode() {
+			transcodes[session.Service]++
+		}
+	}
+	for _, aggregate := range AggregateBandwidth(sessions) {
+		points = append(points, MetricPoint{
+			Name: "server",
+			Tags: map[string]string{"service": aggregate.Service},
+			Fields: map[string]float64{
+				"streams":       float64(aggregate.LANStreams + aggregate.WANStreams),
+				"lan_streams":   float64(aggregate.LANStreams),
+				"wan_streams":   float64(aggregate.WANStreams),
+				"transcodes":    float64(transcodes[aggregate.Service]),
+				"bandwidth":     aggregate.Total,
+				"lan_bandwidth": aggregate.LAN,
+				"wan_bandwidth": aggregate.WAN,
+			},
+			Time: now,
+		})
+	}
+	return points
+}
+
+func sessionMetricPoint(session SessionData, now time.Time) MetricPoint {
+	point := MetricPoint{Name: "session", Tags: make(map[string]string), Fields: make(map[string]float64), Time: now}
+	addMetricValues(&point, "", reflect.ValueOf(session))
+	return point
+}
+
+// Nested structs like MediaRef are flattened with their field name as prefix (media_title)
+func addMetricValues(point *MetricPoint, prefix string, value reflect.Value) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if !field.IsExported() || field.Tag.Get("metric") == "-" {
+			continue
+		}
+		name := prefix + metricName(field.Name)
+		switch v := value.Field(i); v.Kind() {
+		case reflect.Struct:
+			addMetricValues(point, name+"_", v)
+		case reflect.String:
+			if numericSessionFields[field.Name] {
+				if number, err := strconv.ParseFloat(v.String(), 64); err == nil {
+					point.Fields[name] = number
+				}
+			} else if sessionMetricTags[name] && v.String() != "" {
+				point.Tags[name] = v.String()
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			point.Fields[name] = float64(v.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			point.Fields[name] = float64(v.Uint())
+		case reflect.Float32, reflect.Float64:
+			point.Fields[name] = v.Float()
+		case reflect.Bool:
+			point.Fields[name] = 0
+			if v.Bool() {
+				point.Fields[name] = 1
+			}
+		}
+	}
+}
+
+// UserName -> user_name, IPAddress -> ip_address
+func metricName(field string) string {
+	var name strings.Builder
+	runes := []rune(field)
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 && (unicode.IsLower(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+			name.WriteByte('_')
+		}
+		name.WriteRune(unicode.ToLower(r))
+	}
+	return name.String()
+}
+
+// ExportSessions sends a snapshot to every exporter
+func ExportSessions(sessions []SessionData, exporters ...MetricExporter) error {
+	points := SessionMetrics(sessions, time.Now())
+	var errs []string
+	for _, exporter := range exporters {
+		if err := exporter.Export(points); err != nil {
+			errs = append(errs, fmt.Sprintf("%T: %v", exporter, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("exporting metrics: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// RunMetricExport exports every snapshot from a SessionWatcher subscription until ctx is done.
+// With an interval the last snapshot is also exported every interval, so the series have no
+// gaps even when snapshots arrive late or irregularly.
+func RunMetricExport(ctx context.Context, events <-chan SessionEvent, interval time.Duration, exporters ...MetricExporter) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	var last []SessionData
+	received := false
+	export := func() {
+		if err := ExportSessions(last, exporters...); err != nil {
+			logger().Error("exporting metrics failed", "sessions", len(last), "error", err)
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick:
+			if received {
+				export()
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Type != EventSnapshot {
+				continue
+			}
+			last, received = event.Sessions, true
+			export()
+		}
+	}
+}
+
+// InfluxLineProtocol serializes points, tags and fields sorted so output is stable
+func InfluxLineProtocol(points []MetricPoint) []byte {
+	var lines strings.Builder
+	for _, point := range points {
+		if len(point.Fields) == 0 {
+			continue
+		}
+		lines.WriteString(influxEscape(point.Name, ", "))
+		for _, key := range sortedMetricKeys(point.Tags) {
+			fmt.Fprintf(&lines, ",%s=%s", influxEscape(key, ", ="), influxEscape(point.Tags[key], ", ="))
+		}
+		for i, key := range sortedMetricKeys(point.Fields) {
+			separator := ","
+			if i == 0 {
+				separator = " "
+			}
+			fmt.Fprintf(&lines, "%s%s=%s", separator, influxEscape(key, ", ="), strconv.FormatFloat(point.Fields[key], 'f', -1, 64))
+		}
+		fmt.Fprintf(&lines, " %d\n", point.Time.UnixNano())
+	}
+	return []byte(lines.String())
+}
+
+// Line protocol can't escape newlines, they are written as a literal \n
+func influxEscape(s, special string) string {
+	var escaped strings.Builder
+	for _, r := range s {
+		switch r {
+		case '\n':
+			escaped.WriteString(`\n`)
+			continue
+		case '\r':
+			escaped.WriteString(`\r`)
+			continue
+		}
+		if r == '\\' || strings.ContainsRune(special, r) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+// InfluxHTTPExporter writes to the InfluxDB v2 /api/v2/write endpoint
+type InfluxHTTPExporter struct {
+	URL    string // e.g. http://localhost:8086
+	Org    string
+	Bucket string
+	Token  string
+	Client *http.Client // defaults to a client with a 30s timeout
+}
+
+func (e InfluxHTTPExporter) Export(points []MetricPoint) error {
+	query := url.Values{}
+	query.Set("org", e.Org)
+	query.Set("bucket", e.Bucket)
+	query.Set("precision", "ns")
+	endpoint := strings.TrimRight(e.URL, "/") + "/api/v2/write?" + query.Encode()
+	headers := map[string]string{}
+	if e.Token != "" {
+		headers["Authorization"] = "Token " + e.Token
+	}
+	return postPayload(e.Client, endpoint, "text/plain; charset=utf-8", InfluxLineProtocol(points), headers)
+}
+
+// InfluxUDPExporter sends line protocol to an InfluxDB UDP listener (or Telegraf socket_listener)
+type InfluxUDPExporter struct {
+	Addr string // host:port
+}
+
+func (e InfluxUDPExporter) Export(points []MetricPoint) error {
+	conn, err := net.Dial("udp", e.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// One datagram per line keeps us under typical UDP payload limits
+	for _, line := range strings.SplitAfter(string(InfluxLineProtocol(points)), "\n") {
+		if line == "" {
+			continue
+		}
+		if _, err := conn.Write([]byte(line)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OTLPExporter sends points as OTLP/HTTP JSON gauges, named <point>.<field> (e.g. session.bitrate)
+type OTLPExporter struct {
+	Endpoint    string            // e.g. http://localhost:4318/v1/metrics
+	Headers     map[string]string // e.g. auth for a hosted collector
+	ServiceName string            // defaults to "jellyplexgatherer"
+	Client      *http.Client      // defaults to a client with a 30s timeout
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpDataPoint struct {
+	Attributes   []otlpAttribute `json:"attributes"`
+	TimeUnixNano string          `json:"timeUnixNano"`
+	AsDouble     float64         `json:"asDouble"`
+}
+
+type otlpMetric struct {
+	Name  string `json:"name"`
+	Unit  string `json:"unit,omitempty"`
+	Gauge struct {
+		DataPoints []otlpDataPoint `json:"dataPoints"`
+	} `json:"gauge"`
+}
+
+func (e OTLPExporter) Export(points []MetricPoint) error {
+	metrics := make(map[string]*otlpMetric)
+	for _, point := range points {
+		attributes := make([]otlpAttribute, 0, len(point.Tags))
+		for _, key := range sortedMetricKeys(point.Tags) {
+			attribute := otlpAttribute{Key: key}
+			attribute.Value.StringValue = point.Tags[key]
+			attributes = append(attributes, attribute)
+		}
+		for field, value := range point.Fields {
+			name := point.Name + "." + field
+			if metrics[name] == nil {
+				metrics[name] = &otlpMetric{Name: name}
+			}
+			metrics[name].Gauge.DataPoints = append(metrics[name].Gauge.DataPoints, otlpDataPoint{
+				Attributes:   attributes,
+				TimeUnixNano: strconv.FormatInt(point.Time.UnixNano(), 10),
+				AsDouble:     value,
+			})
+		}
+	}
+	names := sortedMetricKeys(metrics)
+	ordered := make([]otlpMetric, 0, len(names))
+	for _, name := range names {
+		ordered = append(ordered, *metrics[name])
+	}
+
+	serviceName := e.ServiceName
+	if serviceName == "" {
+		serviceName = "jellyplexgatherer"
+	}
+	service := otlpAttribute{Key: "service.name"}
+	service.Value.StringValue = serviceName
+	payload := map[string]interface{}{
+		"resourceMetrics": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": []otlpAttribute{service}},
+			"scopeMetrics": []interface{}{map[string]interface{}{
+				"scope":   map[string]string{"name": "github.com/Janczykkkko/jellyplexgatherer"},
+				"metrics": ordered,
+			}},
+		}},
+	}
+	return postJSON(e.Client, e.Endpoint, payload, e.Headers)
+}
+
+func sortedMetricKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,109 @@
+package jellyplexgatherer
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var metricSession = SessionData{
+	UserName:   "alice",
+	UserID:     "u1",
+	Name:       "Heat",
+	Bitrate:    "8.5",
+	PlayMethod: "Transcode",
+	Service:    "Jellyfin",
+	SessionID:  "s1",
+	IPAddress:  "203.0.113.7",
+	DeviceID:   "d1",
+	Location:   LocationWAN,
+	Bandwidth:  4,
+	Media:      MediaRef{Title: "Heat", Year: 1995},
+}
+
+func TestSessionMetricTags(t *testing.T) {
+	point := sessionMetricPoint(metricSession, time.Unix(0, 0))
+	wantTags := map[string]string{"service": "Jellyfin", "user_name": "alice", "play_method": "Transcode"}
+	if !reflect.DeepEqual(point.Tags, wantTags) {
+		t.Errorf("got tags %v, want %v", point.Tags, wantTags)
+	}
+	for field, want := range map[string]float64{"bitrate": 8.5, "bandwidth": 4, "media_year": 1995} {
+		if point.Fields[field] != want {
+			t.Errorf("field %s = %v, want %v", field, point.Fields[field], want)
+		}
+	}
+}
+
+func TestInfluxLineProtocol(t *testing.T) {
+	points := []MetricPoint{
+		{Name: "session", Tags: map[string]string{"user_name": "Jane Doe,\nadmin=1"}, Fields: map[string]float64{"bitrate": 8.5, "video_height": 1080}, Time: time.Unix(1, 5)},
+		{Name: "empty", Tags: map[string]string{"a": "b"}, Time: time.Unix(1, 0)},
+	}
+	want := "session,user_name=Jane\\ Doe\\,\\nadmin\\=1 bitrate=8.5,video_height=1080 1000000005\n"
+	if got := string(InfluxLineProtocol(points)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var payload struct {
+		ResourceMetrics []struct {
+			ScopeMetrics []struct {
+				Metrics []otlpMetric `json:"metrics"`
+			} `json:"scopeMetrics"`
+		} `json:"resourceMetrics"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Authorization") != "Bearer key" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	exporter := OTLPExporter{Endpoint: server.URL, Headers: map[string]string{"Authorization": "Bearer key"}}
+	points := []MetricPoint{{Name: "server", Tags: map[string]string{"service": "Plex"}, Fields: map[string]float64{"streams": 2}, Time: time.Unix(0, 42)}}
+	if err := exporter.Export(points); err != nil {
+		t.Fatal(err)
+	}
+	metrics := payload.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if len(metrics) != 1 || metrics[0].Name != "server.streams" {
+		t.Fatalf("unexpected metrics %+v", metrics)
+	}
+	point := metrics[0].Gauge.DataPoints[0]
+	if point.AsDouble != 2 || point.TimeUnixNano != "42" || point.Attributes[0].Key != "service" || point.Attributes[0].Value.StringValue != "Plex" {
+		t.Errorf("unexpected data point %+v", point)
+	}
+}
+
+func TestRunMetricExportInterval(t *testing.T) {
+	lines := make(chan string, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lines <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	// One snapshot, then nothing changes
+	events := make(chan SessionEvent, 1)
+	events <- SessionEvent{Type: EventSnapshot, Sessions: []SessionData{metricSession}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go RunMetricExport(ctx, events, 20*time.Millisecond, InfluxHTTPExporter{URL: server.URL, Org: "home", Bucket: "media"})
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-lines:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d exports, want at least 3", i)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package jellyplexgatherer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTTPublisher pushes retained session state per device and per user to an MQTT broker
+// and announces matching Home Assistant sensors through MQTT discovery.
+// It speaks just enough MQTT 3.1.1 for QoS 0 publishing.
+//
+// Topics, with the default prefix:
+//
+//	jellyplex/active_streams             number of streams across all servers
+//	jellyplex/device/<device id>/state   JSON state of the device, {"state":"idle"} when nothing plays
+//	jellyplex/user/<user>/state          JSON with the user's stream count and titles
+type MQTTPublisher struct {
+	Broker          string // host:port
+	ClientID        string
+	Username        string
+	Password        string
+	TopicPrefix     string // defaults to "jellyplex"
+	DiscoveryPrefix string // defaults to "homeassistant", empty string disables discovery
+	KeepAlive       time.Duration
+	WriteTimeout    time.Duration // how long a stalled broker can block a publish, defaults to 10s
+
+	mu         sync.Mutex
+	conn       net.Conn
+	devices    map[string]string // topic id -> device name
+	users      map[string]bool
+	discovered map[string]bool
+}
+
+func NewMQTTPublisher(broker, clientID string) *MQTTPublisher {
+	return &MQTTPublisher{
+		Broker:          broker,
+		ClientID:        clientID,
+		TopicPrefix:     "jellyplex",
+		DiscoveryPrefix: "homeassistant",
+		KeepAlive:       60 * time.Second,
+		WriteTimeout:    10 * time.Second,
+		devices:         make(map[string]string),
+		users:           make(map[string]bool),
+		discovered:      make(map[string]bool),
+	}
+}
+
+type mqttDeviceState struct {
+	State    string  `json:"state"`
+	Device   string  `json:"device,omitempty"`
+	User     string  `json:"user,omitempty"`
+	Title    string  `json:"title,omitempty"`
+	Service  string  `json:"service,omitempty"`
+	Bitrate  float64 `json:"bitrate,omitempty"`
+	Method   string  `json:"play_method,omitempty"`
+	Location string  `json:"location,omitempty"`
+}
+
+type mqttUserState struct {
+	Streams int      `json:"streams"`
+	Titles  []string `json:"titles"`
+}
+
+// Publish the state of a snapshot. Devices and users that were seen before but are
+// no longer streaming are published as idle so retained state doesn't go stale.
+// Devices are keyed by DeviceID, two clients with the same name don't share a topic.
+func (p *MQTTPublisher) Publish(sessions []SessionData) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+
+	devices := make(map[string]mqttDeviceState)
+	users := make(map[string]*mqttUserState)
+	for _, session := range sessions {
+		bitrate, _ := strconv.ParseFloat(session.Bitrate, 64)
+		device := mqttDeviceKey(session)
+		if _, ok := p.devices[device]; !ok || session.DeviceName != "" {
+			p.devices[device] = session.DeviceName
+		}
+		devices[device] = mqttDeviceState{
+			State:    session.State,
+			Device:   session.DeviceName,
+			User:     session.UserName,
+			Title:    session.Name,
+			Service:  session.Service,
+			Bitrate:  bitrate,
+			Method:   session.PlayMethod,
+			Location: session.Location,
+		}
+		user := mqttSlug(session.UserName)
+		if users[user] == nil {
+			users[user] = &mqttUserState{Titles: []string{}}
+		}
+		users[user].Streams++
+		users[user].Titles = append(users[user].Titles, session.Name)
+	}
+	for device := range p.devices {
+		if _, ok := devices[device]; !ok {
+			devices[device] = mqttDeviceState{State: "idle"}
+		}
+	}
+	for user := range p.users {
+		if _, ok := users[user]; !ok {
+			users[user] = &mqttUserState{Titles: []string{}}
+		}
+	}
+
+	if err := p.discover("active_streams", "Active streams", "active_streams", "{{ value }}", ""); err != nil {
+		return p.fail(err)
+	}
+	if err := p.publish(p.TopicPrefix+"/active_streams", []byte(strconv.Itoa(len(sessions)))); err != nil {
+		return p.fail(err)
+	}
+	for _, device := range sortedStateKeys(devices) {
+		name := p.devices[device]
+		if name == "" {
+			name = device
+		}
+		topic := "device/" + device + "/state"
+		for _, sensor := range []struct{ id, name, template, unit string }{
+			{"state", "state", "{{ value_json.state }}", ""},
+			{"title", "title", "{{ value_json.title | default('') }}", ""},
+			{"bitrate", "bitrate", "{{ value_json.bitrate | default(0) }}", "Mbit/s"},
+		} {
+			if err := p.discover("device_"+device+"_"+sensor.id, name+" "+sensor.name, topic, sensor.template, sensor.unit); err != nil {
+				return p.fail(err)
+			}
+		}
+		if err := p.publishJSON(p.TopicPrefix+"/"+topic, devices[device]); err != nil {
+			return p.fail(err)
+		}
+	}
+	for user, state := range users {
+		p.users[user] = true
+		topic := "user/" + user + "/state"
+		if err := p.discover("user_"+user+"_streams", user+" streams", topic, "{{ value_json.streams }}", ""); err != nil {
+			return p.fail(err)
+		}
+		if err := p.publishJSON(p.TopicPrefix+"/"+topic, state); err != nil {
+			return p.fail(err)
+		}
+	}
+	return nil
+}
+
+// Run publishes every snapshot from a SessionWatcher subscription and keeps the connection alive
+func (p *MQTTPublisher) Run(ctx context.Context, events <-chan SessionEvent) {
+	keepAlive := p.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = 60 * time.Second
+	}
+	ping := time.NewTicker(keepAlive / 2)
+	defer ping.Stop()
+	defer p.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ping.C:
+			if err := p.ping(); err != nil {
+				logger().Warn("pinging MQTT broker failed", "broker", p.Broker, "error", err)
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Type != EventSnapshot {
+				continue
+			}
+			if err := p.Publish(event.Sessions); err != nil {
+				logger().Error("publishing to MQTT failed", "broker", p.Broker, "error", err)
+			}
+		}
+	}
+}
+
+func (p *MQTTPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	p.write([]byte{0xE0, 0x00}) // DISCONNECT
+	err := p.conn.Close()
+	p.conn = nil
+	return err
+}
+
+func (p *MQTTPublisher) ping() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	if err := p.write([]byte{0xC0, 0x00}); err != nil { // PINGREQ
+		return p.fail(err)
+	}
+	return nil
+}
+
+// must be called with p.mu held
+func (p *MQTTPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.Broker, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	var flags byte = 0x02 // clean session
+	payload := mqttString(p.ClientID)
+	if p.Username != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(p.Username)...)
+		if p.Password != "" {
+			flags |= 0x40
+			payload = append(payload, mqttString(p.Password)...)
+		}
+	}
+	// Covers CONNECT and CONNACK, publishes set their own write deadline
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	keepAlive := int(p.KeepAlive / time.Second)
+	variable := append(mqttString("MQTT"), 0x04, flags, byte(keepAlive>>8), byte(keepAlive))
+	if _, err := conn.Write(mqttPacket(0x10, append(variable, payload...))); err != nil {
+		conn.Close()
+		return err
+	}
+
+	reader := bufio.NewReader(conn)
+	connack := make([]byte, 4)
+	if _, err := io.ReadFull(reader, connack); err != nil {
+		conn.Close()
+		return fmt.Errorf("reading MQTT CONNACK: %v", err)
+	}
+	if connack[0] != 0x20 || connack[3] != 0 {
+		conn.Close()
+		return fmt.Errorf("MQTT broker refused connection, return code %d", connack[3])
+	}
+	conn.SetDeadline(time.Time{})
+	// Drain PINGRESPs and anything else the broker sends, a read error means the connection is gone
+	go io.Copy(io.Discard, reader)
+
+	p.conn = conn
+	return nil
+}
+
+// must be called with p.mu held
+func (p *MQTTPublisher) fail(err error) error {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return err
+}
+
+// must be called with p.mu held
+func (p *MQTTPublisher) publish(topic string, payload []byte) error {
+	if p.conn == nil {
+		return errors.New("not connected to MQTT broker")
+	}
+	// QoS 0, retained
+	return p.write(mqttPacket(0x31, append(mqttString(topic), payload...)))
+}
+
+// must be called with p.mu held
+func (p *MQTTPublisher) write(packet []byte) error {
+	timeout := p.WriteTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := p.conn.Write(packet)
+	return err
+}
+
+// must be called with p.mu held
+func (p *MQTTPublisher) publishJSON(topic string, value interface{}) error {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return p.publish(topic, payload)
+}
+
+// Announce a Home Assistant sensor, configs are retained so once per publisher is enough
+// must be called with p.mu held
+func (p *MQTTPublisher) discover(id, name, topic, valueTemplate, unit string) error {
+	if p.DiscoveryPrefix == "" || p.discovered[id] {
+		return nil
+	}
+	prefix := p.TopicPrefix
+	config := map[string]interface{}{
+		"name":           name,
+		"unique_id":      prefix + "_" + id,
+		"state_topic":    prefix + "/" + topic,
+		"value_template": valueTemplate,
+		"device": map[string]interface{}{
+			"identifiers": []string{prefix},
+			"name":        "Jellyfin/Plex sessions",
+		},
+	}
+	if unit != "" {
+		config["unit_of_measurement"] = unit
+	}
+	if err := p.publishJSON(fmt.Sprintf("%s/sensor/%s_%s/config", p.DiscoveryPrefix, prefix, id), config); err != nil {
+		return err
+	}
+	p.discovered[id] = true
+	return nil
+}
+
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// Fixed header with the variable-length remaining length encoding
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// Topic id of a session's device, DeviceID unless the server didn't send one
+func mqttDeviceKey(session SessionData) string {
+	if session.DeviceID != "" {
+		return mqttSlug(session.DeviceID)
+	}
+	return mqttSlug(session.DeviceName)
+}
+
+// Topic and unique_id safe version of a device id or user name
+func mqttSlug(name string) string {
+	var slug strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			slug.WriteRune(r)
+		} else {
+			slug.WriteRune('_')
+		}
+	}
+	if slug.Len() == 0 {
+		return "unknown"
+	}
+	return slug.String()
+}
+
+func sortedStateKeys(m map[string]mqttDeviceState) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,167 @@
+package jellyplexgatherer
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mqttPacketRead struct {
+	header byte
+	body   []byte
+}
+
+// A broker that accepts one client, answers CONNECT and hands over every packet it reads.
+// A stalled broker stops reading after CONNECT.
+func mqttBroker(t *testing.T, stall bool) (addr string, packets <-chan mqttPacketRead) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+		listener.Close()
+	})
+	received := make(chan mqttPacketRead, 64)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			header, err := reader.ReadByte()
+			if err != nil {
+				return
+			}
+			length, multiplier := 0, 1
+			for {
+				digit, err := reader.ReadByte()
+				if err != nil {
+					return
+				}
+				length += int(digit&0x7F) * multiplier
+				multiplier *= 128
+				if digit&0x80 == 0 {
+					break
+				}
+			}
+			body := make([]byte, length)
+			if _, err := io.ReadFull(reader, body); err != nil {
+				return
+			}
+			received <- mqttPacketRead{header, body}
+			if header == 0x10 {
+				conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+				if stall {
+					<-stop
+					return
+				}
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func readMQTTString(b []byte) (string, []byte) {
+	length := int(b[0])<<8 | int(b[1])
+	return string(b[2 : 2+length]), b[2+length:]
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	addr, packets := mqttBroker(t, false)
+	publisher := NewMQTTPublisher(addr, "gatherer")
+	publisher.Username = "user"
+	publisher.Password = "pass"
+	publisher.DiscoveryPrefix = ""
+	defer publisher.Close()
+
+	// Two clients with the same name
+	sessions := []SessionData{
+		{UserName: "alice", Name: "Heat", DeviceName: "Living Room", DeviceID: "d1", State: "playing"},
+		{UserName: "bob", Name: "Pilot", DeviceName: "Living Room", DeviceID: "d2", State: "paused"},
+	}
+	if err := publisher.Publish(sessions); err != nil {
+		t.Fatal(err)
+	}
+
+	connect := <-packets
+	if connect.header != 0x10 {
+		t.Fatalf("first packet is %#x, want CONNECT", connect.header)
+	}
+	protocol, rest := readMQTTString(connect.body)
+	if protocol != "MQTT" || rest[0] != 4 || rest[1] != 0xC2 || rest[2] != 0 || rest[3] != 60 {
+		t.Errorf("unexpected CONNECT variable header %q %v", protocol, rest[:4])
+	}
+	clientID, rest := readMQTTString(rest[4:])
+	username, rest := readMQTTString(rest)
+	password, _ := readMQTTString(rest)
+	if clientID != "gatherer" || username != "user" || password != "pass" {
+		t.Errorf("unexpected CONNECT payload %q %q %q", clientID, username, password)
+	}
+
+	published := make(map[string]string)
+	for len(published) < 5 {
+		select {
+		case packet := <-packets:
+			if packet.header != 0x31 {
+				t.Fatalf("got packet %#x, want a retained QoS 0 PUBLISH", packet.header)
+			}
+			topic, payload := readMQTTString(packet.body)
+			published[topic] = string(payload)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only got %v", published)
+		}
+	}
+	if published["jellyplex/active_streams"] != "2" {
+		t.Errorf("active streams = %q", published["jellyplex/active_streams"])
+	}
+	var state mqttDeviceState
+	json.Unmarshal([]byte(published["jellyplex/device/d2/state"]), &state)
+	if state.State != "paused" || state.User != "bob" || state.Device != "Living Room" {
+		t.Errorf("unexpected device state %s", published["jellyplex/device/d2/state"])
+	}
+	if !strings.Contains(published["jellyplex/device/d1/state"], `"user":"alice"`) {
+		t.Errorf("unexpected device state %s", published["jellyplex/device/d1/state"])
+	}
+	if published["jellyplex/user/bob/state"] != `{"streams":1,"titles":["Pilot"]}` {
+		t.Errorf("unexpected user state %s", published["jellyplex/user/bob/state"])
+	}
+}
+
+func TestMQTTPublisherStalledBroker(t *testing.T) {
+	addr, _ := mqttBroker(t, true)
+	publisher := NewMQTTPublisher(addr, "gatherer")
+	publisher.DiscoveryPrefix = ""
+	publisher.WriteTimeout = 100 * time.Millisecond
+	defer publisher.Close()
+	if err := publisher.Publish(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes block once the socket buffers are full
+	done := make(chan error, 1)
+	go func() {
+		for {
+			session := SessionData{UserName: "alice", Name: strings.Repeat("x", 1<<20), DeviceID: "d1"}
+			if err := publisher.Publish([]SessionData{session}); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	select {
+	case err := <-done:
+		if !strings.Contains(err.Error(), "timeout") {
+			t.Errorf("got %v, want a write timeout", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("publish blocked on a stalled broker")
+	}
+}
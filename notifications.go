@@ -0,0 +1,306 @@
+package jellyplexgatherer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Event type of the notifications sent for policy violations, see Notifier.PolicyAction
+const EventPolicyViolation = "policy"
+
+// Notification is the rendered text for one event
+type Notification struct {
+	Title   string
+	Message string
+	Event   SessionEvent
+}
+
+type NotificationSink interface {
+	Send(notification Notification) error
+}
+
+var notificationFuncs = template.FuncMap{
+	"playback": func(session SessionData) string {
+		switch {
+		case session.IsTranscode() && session.SourceHeight > 0 && session.VideoHeight > 0:
+			return fmt.Sprintf("transcode %dp→%dp", session.SourceHeight, session.VideoHeight)
+		case session.IsTranscode() && session.VideoHeight > 0:
+			return fmt.Sprintf("transcode %dp", session.VideoHeight)
+		}
+		return strings.ToLower(session.PlayMethod)
+	},
+}
+
+// Default message per event type, override with Notifier.Templates
+var DefaultNotificationTemplates = map[string]string{
+	EventSessionStart:  `{{.Session.UserName}} started {{.Session.Name}} on {{.Session.DeviceName}} ({{playback .Session}})`,
+	EventSessionStop:   `{{.Session.UserName}} stopped {{.Session.Name}} on {{.Session.DeviceName}}`,
+	EventSessionPause:  `{{.Session.UserName}} paused {{.Session.Name}} on {{.Session.DeviceName}}`,
+	EventSessionResume: `{{.Session.UserName}} resumed {{.Session.Name}} on {{.Session.DeviceName}}`,
+}
+
+// Notifier renders session events and sends them to all sinks.
+// Only event types with a template are sent, Filter can drop more. At most RateLimit
+// notifications go out per RatePeriod, the rest are dropped.
+type Notifier struct {
+	Sinks      []NotificationSink
+	Templates  map[string]string // event type -> text/template, defaults to DefaultNotificationTemplates
+	Filter     func(SessionEvent) bool
+	RateLimit  int
+	RatePeriod time.Duration
+
+	mu        sync.Mutex
+	parsed    map[string]*template.Template
+	sentTimes []time.Time
+}
+
+func NewNotifier(sinks ...NotificationSink) *Notifier {
+	return &Notifier{Sinks: sinks, RateLimit: 10, RatePeriod: time.Minute}
+}
+
+// Notify renders the event and sends it to every sink
+func (n *Notifier) Notify(event SessionEvent) error {
+	if n.Filter != nil && !n.Filter(event) {
+		return nil
+	}
+	tmpl, err := n.template(event.Type)
+	if err != nil || tmpl == nil {
+		return err
+	}
+	var message bytes.Buffer
+	if err := tmpl.Execute(&message, event); err != nil {
+		return fmt.Errorf("rendering %s notification: %v", event.Type, err)
+	}
+	if !n.allow(time.Now()) {
+		logger().Warn("notification rate limit reached, dropping", "event", event.Type, "message", message.String())
+		return nil
+	}
+	title := "Media server"
+	if event.Session != nil {
+		title = event.Session.Service
+	}
+	return n.send(Notification{Title: title, Message: message.String(), Event: event})
+}
+
+// PolicyAction lets a PolicyEngine report violations through this notifier's sinks. Filter
+// sees them as EventPolicyViolation events carrying the targeted sessions.
+func (n *Notifier) PolicyAction() NotifyAction {
+	return func(violation PolicyViolation) error {
+		event := SessionEvent{Type: EventPolicyViolation, Time: time.Now(), Sessions: violation.Sessions}
+		if len(violation.Sessions) > 0 {
+			event.Session = &violation.Sessions[0]
+		}
+		if n.Filter != nil && !n.Filter(event) {
+			return nil
+		}
+		if !n.allow(event.Time) {
+			return nil
+		}
+		return n.send(Notification{
+			Title:   "Policy " + violation.Rule,
+			Message: fmt.Sprintf("%s: %s", violation.UserName, violation.Reason),
+			Event:   event,
+		})
+	}
+}
+
+// Run notifies about every event from a SessionWatcher subscription until ctx is done
+func (n *Notifier) Run(ctx context.Context, events <-chan SessionEvent) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if err := n.Notify(event); err != nil {
+				logger().Error("sending notification failed", "event", event.Type, "error", err)
+			}
+		}
+	}
+}
+
+func (n *Notifier) send(notification Notification) error {
+	var errs []string
+	for _, sink := range n.Sinks {
+		if err := sink.Send(notification); err != nil {
+			errs = append(errs, fmt.Sprintf("%T: %v", sink, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("sending notification: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (n *Notifier) template(eventType string) (*template.Template, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if tmpl, ok := n.parsed[eventType]; ok {
+		return tmpl, nil
+	}
+	templates := n.Templates
+	if templates == nil {
+		templates = DefaultNotificationTemplates
+	}
+	text, ok := templates[eventType]
+	if !ok {
+		return nil, nil
+	}
+	tmpl, err := template.New(eventType).Funcs(notificationFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s notification template: %v", eventType, err)
+	}
+	if n.parsed == nil {
+		n.parsed = make(map[string]*template.Template)
+	}
+	n.parsed[eventType] = tmpl
+	return tmpl, nil
+}
+
+func (n *Notifier) allow(now time.Time) bool {
+	if n.RateLimit <= 0 {
+		return true
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	cutoff := now.Add(-n.RatePeriod)
+	kept := n.sentTimes[:0]
+	for _, sent := range n.sentTimes {
+		if sent.After(cutoff) {
+			kept = append(kept, sent)
+		}
+	}
+	n.sentTimes = kept
+	if len(n.sentTimes) >= n.RateLimit {
+		return false
+	}
+	n.sentTimes = append(n.sentTimes, now)
+	return true
+}
+
+// Used by sinks and exporters without a Client. HTTPClient is left to Plex and Jellyfin, its
+// transport may record traffic, replay it or count failures towards the media servers.
+var defaultPostClient = &http.Client{Timeout: 30 * time.Second}
+
+// POST a payload and fail on non-2xx responses, shared by notification sinks and metric exporters
+func postPayload(client *http.Client, endpoint, contentType string, body []byte, headers map[string]string) error {
+	if client == nil {
+		client = defaultPostClient
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(snippet)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func postJSON(client *http.Client, endpoint string, payload interface{}, headers map[string]string) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return postPayload(client, endpoint, "application/json", body, headers)
+}
+
+type DiscordSink struct {
+	WebhookURL string
+	Client     *http.Client // defaults to a client with a 30s timeout
+}
+
+func (s DiscordSink) Send(notification Notification) error {
+	return postJSON(s.Client, s.WebhookURL, map[string]string{
+		"content": fmt.Sprintf("**%s**: %s", notification.Title, notification.Message),
+	}, nil)
+}
+
+type SlackSink struct {
+	WebhookURL string
+	Client     *http.Client // defaults to a client with a 30s timeout
+}
+
+func (s SlackSink) Send(notification Notification) error {
+	return postJSON(s.Client, s.WebhookURL, map[string]string{
+		"text": fmt.Sprintf("*%s*: %s", notification.Title, notification.Message),
+	}, nil)
+}
+
+// NtfySink publishes to a topic on ntfy.sh or a self-hosted ntfy server
+type NtfySink struct {
+	ServerURL string // e.g. https://ntfy.sh
+	Topic     string
+	Token     string       // optional access token
+	Client    *http.Client // defaults to a client with a 30s timeout
+}
+
+func (s NtfySink) Send(notification Notification) error {
+	headers := map[string]string{"Title": notification.Title}
+	if s.Token != "" {
+		headers["Authorization"] = "Bearer " + s.Token
+	}
+	endpoint := strings.TrimRight(s.ServerURL, "/") + "/" + s.Topic
+	return postPayload(s.Client, endpoint, "text/plain", []byte(notification.Message), headers)
+}
+
+type GotifySink struct {
+	ServerURL string
+	Token     string // application token
+	Priority  int
+	Client    *http.Client // defaults to a client with a 30s timeout
+}
+
+func (s GotifySink) Send(notification Notification) error {
+	endpoint := strings.TrimRight(s.ServerURL, "/") + "/message"
+	return postJSON(s.Client, endpoint, map[string]interface{}{
+		"title":    notification.Title,
+		"message":  notification.Message,
+		"priority": s.Priority,
+	}, map[string]string{"X-Gotify-Key": s.Token})
+}
+
+// SMTPSink sends plain text mail, Username enables PLAIN auth (which needs TLS unless the server is local)
+type SMTPSink struct {
+	Addr     string // host:port
+	Username string
+	Password string
+	From     string
+	To       []string
+}
+
+func (s SMTPSink) Send(notification Notification) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host := s.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		s.From, strings.Join(s.To, ", "), notification.Title, notification.Message)
+	return smtp.SendMail(s.Addr, auth, s.From, s.To, []byte(msg))
+}
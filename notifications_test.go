@@ -0,0 +1,229 @@
+package jellyplexgatherer
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type capturedRequest struct {
+	path    string
+	headers http.Header
+	body    string
+}
+
+func captureServer(t *testing.T) (*httptest.Server, <-chan capturedRequest) {
+	requests := make(chan capturedRequest, 8)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- capturedRequest{path: r.URL.Path, headers: r.Header, body: string(body)}
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+var notification = Notification{Title: "Plex", Message: "bob started Pilot on Phone (transcode 1080p→720p)"}
+
+func TestWebhookSinks(t *testing.T) {
+	server, requests := captureServer(t)
+	tests := []struct {
+		sink    NotificationSink
+		path    string
+		body    string
+		headers map[string]string
+	}{
+		{DiscordSink{WebhookURL: server.URL + "/discord"}, "/discord", `{"content":"**Plex**: ` + notification.Message + `"}`, nil},
+		{SlackSink{WebhookURL: server.URL + "/slack"}, "/slack", `{"text":"*Plex*: ` + notification.Message + `"}`, nil},
+		{NtfySink{ServerURL: server.URL + "/", Topic: "media", Token: "tk"}, "/media", notification.Message, map[string]string{"Title": "Plex", "Authorization": "Bearer tk"}},
+		{GotifySink{ServerURL: server.URL, Token: "app", Priority: 5}, "/message", `{"message":"` + notification.Message + `","priority":5,"title":"Plex"}`, map[string]string{"X-Gotify-Key": "app"}},
+	}
+	for _, test := range tests {
+		if err := test.sink.Send(notification); err != nil {
+			t.Fatalf("%T: %v", test.sink, err)
+		}
+		request := <-requests
+		if request.path != test.path {
+			t.Errorf("%T posted to %s, want %s", test.sink, request.path, test.path)
+		}
+		if request.headers.Get("Content-Type") == "application/json" {
+			var got, want interface{}
+			json.Unmarshal([]byte(request.body), &got)
+			json.Unmarshal([]byte(test.body), &want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%T posted %s, want %s", test.sink, request.body, test.body)
+			}
+		} else if request.body != test.body {
+			t.Errorf("%T posted %q, want %q", test.sink, request.body, test.body)
+		}
+		for key, want := range test.headers {
+			if got := request.headers.Get(key); got != want {
+				t.Errorf("%T sent %s %q, want %q", test.sink, key, got, want)
+			}
+		}
+	}
+}
+
+func TestWebhookSinkError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid webhook token", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	err := DiscordSink{WebhookURL: server.URL}.Send(notification)
+	if err == nil || !strings.Contains(err.Error(), "invalid webhook token") {
+		t.Errorf("got %v, want the webhook's error", err)
+	}
+}
+
+// A minimal SMTP server that accepts one mail and hands over the DATA section
+func smtpStandIn(t *testing.T) (addr string, mail <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+		reply("220 localhost ESMTP")
+		var data strings.Builder
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch command := strings.ToUpper(strings.Fields(line + " x")[0]); command {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "MAIL", "RCPT", "RSET", "NOOP":
+				reply("250 OK")
+			case "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				reply("250 queued")
+				received <- data.String()
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("502 not implemented")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestSMTPSink(t *testing.T) {
+	addr, mail := smtpStandIn(t)
+	sink := SMTPSink{Addr: addr, From: "media@example.com", To: []string{"admin@example.com"}}
+	if err := sink.Send(notification); err != nil {
+		t.Fatal(err)
+	}
+	got := <-mail
+	for _, want := range []string{"To: admin@example.com\r\n", "Subject: Plex\r\n", notification.Message} {
+		if !strings.Contains(got, want) {
+			t.Errorf("mail %q doesn't contain %q", got, want)
+		}
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	server, requests := captureServer(t)
+	notifier := NewNotifier(SlackSink{WebhookURL: server.URL})
+	notifier.Filter = func(event SessionEvent) bool {
+		return event.Session == nil || event.Session.UserName != "carol"
+	}
+
+	bob := SessionData{Service: "Plex", UserName: "bob", Name: "Pilot", DeviceName: "Phone", PlayMethod: "transcode", SourceHeight: 1080, VideoHeight: 720}
+	if err := notifier.Notify(SessionEvent{Type: EventSessionStart, Session: &bob}); err != nil {
+		t.Fatal(err)
+	}
+	if body := (<-requests).body; !strings.Contains(body, "bob started Pilot on Phone (transcode 1080p→720p)") {
+		t.Errorf("unexpected notification %s", body)
+	}
+
+	// Policy notifications go through Filter too
+	carol := SessionData{Service: "Jellyfin", UserName: "carol"}
+	notifier.PolicyAction()(PolicyViolation{Rule: "max-streams-1", UserName: "carol", Reason: "2 streams", Sessions: []SessionData{carol}})
+	notifier.PolicyAction()(PolicyViolation{Rule: "max-streams-1", UserName: "bob", Reason: "2 streams", Sessions: []SessionData{bob}})
+	if body := (<-requests).body; !strings.Contains(body, "bob: 2 streams") {
+		t.Errorf("unexpected policy notification %s", body)
+	}
+	if len(requests) != 0 {
+		t.Errorf("filtered policy notification was sent")
+	}
+}
+
+type countingTransport struct {
+	requests int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.requests++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestSinksUseOwnClient(t *testing.T) {
+	server, requests := captureServer(t)
+	shared := &countingTransport{}
+	defer func(client *http.Client) { HTTPClient = client }(HTTPClient)
+	HTTPClient = &http.Client{Transport: shared}
+
+	// Without a Client the sink stays off HTTPClient too
+	if err := (SlackSink{WebhookURL: server.URL}).Send(notification); err != nil {
+		t.Fatal(err)
+	}
+	<-requests
+	own := &countingTransport{}
+	if err := (GotifySink{ServerURL: server.URL, Client: &http.Client{Transport: own}}).Send(notification); err != nil {
+		t.Fatal(err)
+	}
+	<-requests
+	if shared.requests != 0 || own.requests != 1 {
+		t.Errorf("got %d requests through HTTPClient and %d through the sink's client, want 0 and 1", shared.requests, own.requests)
+	}
+}
+
+func TestNotifierRateLimit(t *testing.T) {
+	server, requests := captureServer(t)
+	notifier := NewNotifier(SlackSink{WebhookURL: server.URL})
+	notifier.RateLimit = 2
+
+	bob := SessionData{Service: "Plex", UserName: "bob", Name: "Pilot", DeviceName: "Phone"}
+	for i := 0; i < 3; i++ {
+		if err := notifier.Notify(SessionEvent{Type: EventSessionPause, Session: &bob}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	violation := PolicyViolation{Rule: "max-streams-1", UserName: "bob", Reason: "2 streams", Sessions: []SessionData{bob}}
+	if err := notifier.PolicyAction()(violation); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 {
+		t.Errorf("sent %d notifications, want 2", len(requests))
+	}
+
+	// A period later the earlier notifications no longer count
+	later := time.Now().Add(notifier.RatePeriod + time.Second)
+	if !notifier.allow(later) || !notifier.allow(later) || notifier.allow(later) {
+		t.Error("rate limit window didn't slide")
+	}
+}
@@ -4,58 +4,79 @@ import (
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
-	"log"
-	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Get Plex data and parse it into a struct
 func GetPlexData(plexAddress, plexApiKey string) (sessions PlexSessions, err error) {
 	url := fmt.Sprintf(plexAddress + "/status/sessions?X-Plex-Token=" + plexApiKey)
-	resp, err := http.Get(url)
+	start := time.Now()
+	resp, err := HTTPClient.Get(url)
 	if err != nil {
 		return PlexSessions{}, err
 	}
 	defer resp.Body.Close()
-	log.Printf("API request to Plex at %s completed with status code: %d", plexAddress, resp.StatusCode)
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return PlexSessions{}, err
 	}
+	logResponse("plex", plexAddress, "/status/sessions", resp.StatusCode, time.Since(start), body)
+	if err := checkResponse("plex", "/status/sessions", resp, body, "application/xml", "text/xml"); err != nil {
+		return PlexSessions{}, err
+	}
 	err = xml.Unmarshal(body, &sessions)
 	if err != nil {
 		return PlexSessions{}, err
 	}
-	log.Println("Plex sessions scraped succesfully")
 	return sessions, nil
 }
 
-// Ingest Plex data and assign per stream
+// Ingest Plex data and assign per stream, music plays as Track elements next to the Videos
 func GetPlexSessions(plexAddress, plexApiKey string) (plexsessions []SessionData, err error) {
 	sessions, err := GetPlexData(plexAddress, plexApiKey)
 	if err != nil {
 		return nil, err
 	}
 	for _, session := range sessions.Video {
-		data := SessionData{
-			UserName:   session.User.Title,
-			Name:       getPlexTitle(session),
-			Bitrate:    getPlexStreamBitrate(session),
-			PlayMethod: session.Media.Part.Decision,
-			SubStream:  getPlexSubStream(session),
-			DeviceName: getPlexDevice(session),
-			Service:    "Plex",
-		}
-		plexsessions = append(plexsessions, data)
+		plexsessions = append(plexsessions, getPlexSessionData(session))
+	}
+	for _, session := range sessions.Track {
+		plexsessions = append(plexsessions, getPlexSessionData(session))
 	}
 	return plexsessions, nil
 }
 
+func getPlexSessionData(session PlexVideoSession) SessionData {
+	return SessionData{
+		UserName:      session.User.Title,
+		UserID:        session.User.ID,
+		Name:          getPlexTitle(session),
+		Bitrate:       getPlexStreamBitrate(session),
+		PlayMethod:    session.Media.Part.Decision,
+		SubStream:     getPlexSubStream(session),
+		DeviceName:    getPlexDevice(session),
+		Service:       "Plex",
+		SessionID:     session.Session.ID,
+		State:         session.Player.State,
+		IPAddress:     session.Player.Address,
+		PublicAddress: session.Player.RemotePublicAddress,
+		DeviceID:      session.Player.MachineIdentifier,
+		VideoHeight:   getPlexVideoHeight(session),
+		SourceHeight:  getPlexSourceHeight(session),
+		Location:      getPlexLocation(session),
+		Bandwidth:     getPlexBandwidth(session),
+		Media:         getPlexMediaRef(session),
+		Images:        getPlexImages(session),
+	}
+}
+
 // convert bitrate
 func getPlexStreamBitrate(session PlexVideoSession) string {
 	bitrateInt, err := strconv.Atoi(session.Media.Bitrate)
 	if err != nil {
-		log.Printf("Error processing plex stream bitrate: %s", err)
+		logger().Warn("invalid Plex stream bitrate", "backend", "plex", "session", session.Session.ID, "bitrate", session.Media.Bitrate)
 		return "Error"
 	}
 	return strconv.FormatFloat(float64(bitrateInt)/1000.0, 'f', -1, 64)
@@ -86,3 +107,61 @@ func getPlexTitle(session PlexVideoSession) string {
 	}
 	return session.Title
 }
+
+// Height is missing on some clients, fall back to the resolution label
+func getPlexVideoHeight(session PlexVideoSession) int {
+	if height, err := strconv.Atoi(session.Media.Height); err == nil {
+		return height
+	}
+	return plexResolutionHeight(session.Media.VideoResolution)
+}
+
+// Media describes the transcoder's output, the video stream's title still names the source
+// resolution, e.g. "1080p (HEVC Main 10)"
+func getPlexSourceHeight(session PlexVideoSession) int {
+	if !strings.EqualFold(session.Media.Part.Decision, "transcode") {
+		return getPlexVideoHeight(session)
+	}
+	for _, stream := range session.Media.Part.Stream {
+		if stream.StreamType == "1" {
+			if label := strings.Fields(stream.DisplayTitle); len(label) > 0 {
+				return plexResolutionHeight(label[0])
+			}
+		}
+	}
+	return 0
+}
+
+// "1080p", "720", "4K" or "SD" to a height in pixels
+func plexResolutionHeight(resolution string) int {
+	switch strings.ToLower(resolution) {
+	case "":
+		return 0
+	case "4k":
+		return 2160
+	case "sd":
+		return 480
+	}
+	height, _ := strconv.Atoi(strings.TrimSuffix(strings.ToLower(resolution), "p"))
+	return height
+}
+
+// Plex tells us itself whether the client is on the LAN
+func getPlexLocation(session PlexVideoSession) string {
+	if session.Session.Location != "" {
+		return session.Session.Location
+	}
+	if session.Player.Local == "1" {
+		return "lan"
+	}
+	return locationFromAddress(session.Player.Address)
+}
+
+// Session bandwidth is in kbps, older servers don't send it
+func getPlexBandwidth(session PlexVideoSession) float64 {
+	bandwidth, err := strconv.Atoi(session.Session.Bandwidth)
+	if err != nil {
+		bandwidth, _ = strconv.Atoi(session.Media.Bitrate)
+	}
+	return float64(bandwidth) / 1000.0
+}
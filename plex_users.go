@@ -0,0 +1,150 @@
+package jellyplexgatherer
+
+import (
+	"fmt"
+	"sort"
+)
+
+// PlexTVAddress is where the shared and home user lists come from. Point it at a fake, e.g.
+// testserver.Plex, in tests.
+var PlexTVAddress = "https://plex.tv"
+
+// The server calls its owner account 1, whatever the plex.tv id is
+const plexOwnerAccountID = "1"
+
+// PlexUser is an account that can play from the server
+type PlexUser struct {
+	ID       string // server account id, the User id of sessions
+	Name     string // friendly name, the home user title or the plex.tv username
+	Username string // plex.tv username, empty for managed users
+	Email    string
+	Thumb    string
+	Owner    bool
+	Home     bool // member of the owner's Plex Home
+	Managed  bool // home user without its own plex.tv account
+	Shared   bool // friend the server is shared with
+}
+
+// PlexUsers maps server account ids to users
+type PlexUsers map[string]PlexUser
+
+// Name returns the friendly name of an account, empty if it's unknown
+func (u PlexUsers) Name(id string) string {
+	return u[id].Name
+}
+
+// Sorted returns the users sorted by name
+func (u PlexUsers) Sorted() []PlexUser {
+	users := make([]PlexUser, 0, len(u))
+	for _, user := range u {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// Resolve replaces the UserName of Plex sessions with the friendly name of their account, so
+// a user shows up under the same name on every client. sessions is modified in place.
+func (u PlexUsers) Resolve(sessions []SessionData) []SessionData {
+	for i := range sessions {
+		if sessions[i].Service != "Plex" {
+			continue
+		}
+		if name := u.Name(sessions[i].UserID); name != "" {
+			sessions[i].UserName = name
+		}
+	}
+	return sessions
+}
+
+type plexAccounts struct {
+	Account []struct {
+		ID    string `xml:"id,attr"`
+		Name  string `xml:"name,attr"`
+		Thumb string `xml:"thumb,attr"`
+	} `xml:"Account"`
+}
+
+type plexTVUsers struct {
+	User []plexTVUser `xml:"User"`
+}
+
+type plexTVUser struct {
+	ID         string `xml:"id,attr"`
+	Title      string `xml:"title,attr"`
+	Username   string `xml:"username,attr"`
+	Email      string `xml:"email,attr"`
+	Thumb      string `xml:"thumb,attr"`
+	Home       string `xml:"home,attr"`
+	Admin      string `xml:"admin,attr"`
+	Restricted string `xml:"restricted,attr"`
+}
+
+// GetPlexUsers lists the server's accounts and fills them in from the plex.tv lists of
+// shared and home users. Those need the owner's token, if they fail the server accounts
+// are returned together with the error.
+func GetPlexUsers(plexAddress, plexApiKey string) (PlexUsers, error) {
+	var accounts plexAccounts
+	if err := getXML("plex", plexAddress+"/accounts?X-Plex-Token="+plexApiKey, &accounts); err != nil {
+		return nil, err
+	}
+	users := make(PlexUsers)
+	for _, account := range accounts.Account {
+		// Account 0 is the server itself
+		if account.ID == "" || account.ID == "0" {
+			continue
+		}
+		users[account.ID] = PlexUser{
+			ID:    account.ID,
+			Name:  account.Name,
+			Thumb: account.Thumb,
+			Owner: account.ID == plexOwnerAccountID,
+		}
+	}
+
+	var shared, home plexTVUsers
+	if err := getXML("plex.tv", PlexTVAddress+"/api/users?X-Plex-Token="+plexApiKey, &shared); err != nil {
+		return users, fmt.Errorf("listing plex.tv shared users: %w", err)
+	}
+	if err := getXML("plex.tv", PlexTVAddress+"/api/home/users?X-Plex-Token="+plexApiKey, &home); err != nil {
+		return users, fmt.Errorf("listing plex.tv home users: %w", err)
+	}
+	for _, entry := range shared.User {
+		users.merge(entry, entry.Home == "1")
+	}
+	for _, entry := range home.User {
+		users.merge(entry, true)
+	}
+	return users, nil
+}
+
+// Fold a plex.tv user into the server account it plays as
+func (u PlexUsers) merge(entry plexTVUser, home bool) {
+	id := entry.ID
+	if entry.Admin == "1" {
+		id = plexOwnerAccountID
+	}
+	user := u[id]
+	user.ID = id
+	user.Owner = user.Owner || id == plexOwnerAccountID
+	user.Home = user.Home || home
+	user.Shared = user.Shared || !home
+	user.Managed = user.Managed || (entry.Restricted == "1" && entry.Username == "")
+	if entry.Username != "" {
+		user.Username = entry.Username
+	}
+	if entry.Email != "" {
+		user.Email = entry.Email
+	}
+	if entry.Thumb != "" {
+		user.Thumb = entry.Thumb
+	}
+	// plex.tv titles are what Plex apps show, the server keeps whatever name it first saw
+	switch {
+	case entry.Title != "":
+		user.Name = entry.Title
+	case user.Name == "":
+		user.Name = entry.Username
+	}
+	u[id] = user
+}
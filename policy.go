@@ -0,0 +1,350 @@
+package jellyplexgatherer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PolicyViolation is what a rule reports, Sessions are the streams actions should target
+type PolicyViolation struct {
+	Rule     string
+	Key      string // identifies the violation across evaluations, used for grace periods
+	UserName string
+	Reason   string
+	Sessions []SessionData
+}
+
+type PolicyRule interface {
+	Name() string
+	Evaluate(sessions []SessionData) []PolicyViolation
+}
+
+type PolicyAction interface {
+	Execute(violation PolicyViolation) error
+}
+
+// Policy ties a rule to actions. Warn actions fire as soon as a violation shows up, Enforce
+// actions fire once it has persisted for GracePeriod. Both fire once per violation.
+type Policy struct {
+	Rule        PolicyRule
+	GracePeriod time.Duration
+	Warn        []PolicyAction
+	Enforce     []PolicyAction
+}
+
+type violationState struct {
+	firstSeen time.Time
+	enforced  bool
+}
+
+// PolicyEngine evaluates policies against session snapshots from Plex and Jellyfin.
+// Rules get the sessions oldest first, ordered by when the engine first saw them.
+type PolicyEngine struct {
+	Policies []Policy
+
+	mu      sync.Mutex
+	state   map[string]*violationState
+	started map[string]time.Time // session key -> first seen
+}
+
+type pendingActions struct {
+	actions   []PolicyAction
+	violation PolicyViolation
+}
+
+func NewPolicyEngine(policies ...Policy) *PolicyEngine {
+	return &PolicyEngine{Policies: policies, state: make(map[string]*violationState), started: make(map[string]time.Time)}
+}
+
+// Evaluate a snapshot and run due actions, returns all current violations
+func (e *PolicyEngine) Evaluate(sessions []SessionData) []PolicyViolation {
+	return e.evaluate(sessions, time.Now())
+}
+
+func (e *PolicyEngine) evaluate(sessions []SessionData, now time.Time) (violations []PolicyViolation) {
+	// Actions talk to the servers, run them after unlocking
+	var due []pendingActions
+	defer func() {
+		for _, pending := range due {
+			runPolicyActions(pending.actions, pending.violation)
+		}
+	}()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	sessions = e.oldestFirst(sessions, now)
+	seen := make(map[string]bool)
+	for _, policy := range e.Policies {
+		for _, violation := range policy.Rule.Evaluate(sessions) {
+			violations = append(violations, violation)
+			key := policy.Rule.Name() + "|" + violation.Key
+			seen[key] = true
+
+			state, ok := e.state[key]
+			if !ok {
+				state = &violationState{firstSeen: now}
+				e.state[key] = state
+				due = append(due, pendingActions{policy.Warn, violation})
+			}
+			if !state.enforced && now.Sub(state.firstSeen) >= policy.GracePeriod {
+				state.enforced = true
+				due = append(due, pendingActions{policy.Enforce, violation})
+			}
+		}
+	}
+	// Violations that went away reset their grace period
+	for key := range e.state {
+		if !seen[key] {
+			delete(e.state, key)
+		}
+	}
+	return violations
+}
+
+// Sort a copy of sessions by when they were first seen, must be called with e.mu held
+func (e *PolicyEngine) oldestFirst(sessions []SessionData, now time.Time) []SessionData {
+	if e.started == nil {
+		e.started = make(map[string]time.Time)
+	}
+	current := make(map[string]bool, len(sessions))
+	for _, session := range sessions {
+		key := sessionKey(session)
+		current[key] = true
+		if _, ok := e.started[key]; !ok {
+			e.started[key] = now
+		}
+	}
+	for key := range e.started {
+		if !current[key] {
+			delete(e.started, key)
+		}
+	}
+	sorted := append([]SessionData(nil), sessions...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return e.started[sessionKey(sorted[i])].Before(e.started[sessionKey(sorted[j])])
+	})
+	return sorted
+}
+
+// Run evaluates every snapshot coming from a SessionWatcher subscription until ctx is done.
+// The watcher sends one per poll, so grace periods are enforced within a poll interval.
+func (e *PolicyEngine) Run(ctx context.Context, events <-chan SessionEvent) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Type == EventSnapshot {
+				e.Evaluate(event.Sessions)
+			}
+		}
+	}
+}
+
+func runPolicyActions(actions []PolicyAction, violation PolicyViolation) {
+	for _, action := range actions {
+		if err := action.Execute(violation); err != nil {
+			logger().Error("policy action failed", "rule", violation.Rule, "user", violation.UserName, "error", err)
+		}
+	}
+}
+
+// Users are matched by name so one account is counted across Plex and Jellyfin
+func sessionsByUser(sessions []SessionData) (users []string, byUser map[string][]SessionData) {
+	byUser = make(map[string][]SessionData)
+	for _, session := range sessions {
+		user := strings.ToLower(session.UserName)
+		if _, ok := byUser[user]; !ok {
+			users = append(users, user)
+		}
+		byUser[user] = append(byUser[user], session)
+	}
+	return users, byUser
+}
+
+// MaxStreamsRule limits concurrent streams per user. Sessions are expected oldest first, as
+// PolicyEngine passes them, so the newest streams over the limit are targeted.
+type MaxStreamsRule struct {
+	Max int
+}
+
+func (r MaxStreamsRule) Name() string {
+	return fmt.Sprintf("max-streams-%d", r.Max)
+}
+
+func (r MaxStreamsRule) Evaluate(sessions []SessionData) (violations []PolicyViolation) {
+	users, byUser := sessionsByUser(sessions)
+	for _, user := range users {
+		userSessions := byUser[user]
+		if len(userSessions) <= r.Max {
+			continue
+		}
+		violations = append(violations, PolicyViolation{
+			Rule:     r.Name(),
+			Key:      user,
+			UserName: userSessions[0].UserName,
+			Reason:   fmt.Sprintf("%d concurrent streams, limit is %d", len(userSessions), r.Max),
+			Sessions: userSessions[r.Max:],
+		})
+	}
+	return violations
+}
+
+// MaxIPsRule limits distinct public addresses per user, streams from the extra addresses are
+// targeted. A household behind one router or a Plex relay counts once, sessions without an
+// address don't count.
+type MaxIPsRule struct {
+	Max int
+}
+
+func (r MaxIPsRule) Name() string {
+	return fmt.Sprintf("max-ips-%d", r.Max)
+}
+
+func (r MaxIPsRule) Evaluate(sessions []SessionData) (violations []PolicyViolation) {
+	users, byUser := sessionsByUser(sessions)
+	for _, user := range users {
+		var ips []string
+		var extra []SessionData
+		for _, session := range byUser[user] {
+			address := session.PublicIP()
+			if ip := parseEndPoint(address); ip != nil {
+				address = ip.String()
+			}
+			if address == "" {
+				continue
+			}
+			known := false
+			for _, ip := range ips {
+				known = known || ip == address
+			}
+			if !known {
+				ips = append(ips, address)
+			}
+			if len(ips) > r.Max {
+				extra = append(extra, session)
+			}
+		}
+		if len(ips) <= r.Max {
+			continue
+		}
+		violations = append(violations, PolicyViolation{
+			Rule:     r.Name(),
+			Key:      user,
+			UserName: byUser[user][0].UserName,
+			Reason:   fmt.Sprintf("streaming from %d addresses (%s), limit is %d", len(ips), strings.Join(ips, ", "), r.Max),
+			Sessions: extra,
+		})
+	}
+	return violations
+}
+
+// RemoteTranscodeRule forbids remote transcodes above MaxHeight (e.g. 1080)
+type RemoteTranscodeRule struct {
+	MaxHeight int
+	IsRemote  func(SessionData) bool // defaults to IsRemoteSession
+}
+
+func (r RemoteTranscodeRule) Name() string {
+	return fmt.Sprintf("remote-transcode-above-%dp", r.MaxHeight)
+}
+
+func (r RemoteTranscodeRule) Evaluate(sessions []SessionData) (violations []PolicyViolation) {
+	isRemote := r.IsRemote
+	if isRemote == nil {
+		isRemote = IsRemoteSession
+	}
+	for _, session := range sessions {
+		if !session.IsTranscode() || session.VideoHeight <= r.MaxHeight || !isRemote(session) {
+			continue
+		}
+		violations = append(violations, PolicyViolation{
+			Rule:     r.Name(),
+			Key:      sessionKey(session),
+			UserName: session.UserName,
+			Reason:   fmt.Sprintf("remote transcode of %s at %dp, limit is %dp", session.Name, session.VideoHeight, r.MaxHeight),
+			Sessions: []SessionData{session},
+		})
+	}
+	return violations
+}
+
+// A session is remote when tagged WAN, untagged sessions fall back to their client address
+func IsRemoteSession(session SessionData) bool {
+	if session.Location != "" {
+		return session.Location == LocationWAN
+	}
+	return locationFromAddress(session.IPAddress) == LocationWAN
+}
+
+// LogAction writes the violation to Logger, or to slog's default logger when it's nil
+type LogAction struct {
+	Logger *slog.Logger
+}
+
+func (a LogAction) Execute(violation PolicyViolation) error {
+	l := a.Logger
+	if l == nil {
+		l = slog.Default()
+	}
+	l.Warn("policy violated", "rule", violation.Rule, "user", violation.UserName, "reason", violation.Reason, "sessions", len(violation.Sessions))
+	return nil
+}
+
+// NotifyAction hands the violation to a callback, e.g. a chat webhook
+type NotifyAction func(violation PolicyViolation) error
+
+func (f NotifyAction) Execute(violation PolicyViolation) error {
+	return f(violation)
+}
+
+// MessageAction shows a message on every targeted session's client
+type MessageAction struct {
+	JellyfinAddress, JellyfinApiKey string
+	PlexAddress, PlexApiKey         string
+	Message                         Message
+}
+
+func (a MessageAction) Execute(violation PolicyViolation) error {
+	var errs []error
+	for _, session := range violation.Sessions {
+		msg := a.Message
+		if msg.Text == "" {
+			msg.Text = violation.Reason
+		}
+		if err := SendMessage(a.JellyfinAddress, a.JellyfinApiKey, a.PlexAddress, a.PlexApiKey, session, msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// TerminateAction stops every targeted session
+type TerminateAction struct {
+	JellyfinAddress, JellyfinApiKey string
+	PlexAddress, PlexApiKey         string
+	Options                         KillOptions
+}
+
+func (a TerminateAction) Execute(violation PolicyViolation) error {
+	var errs []error
+	for _, session := range violation.Sessions {
+		opts := a.Options
+		if opts.Reason == "" {
+			opts.Reason = violation.Reason
+		}
+		if err := KillSession(a.JellyfinAddress, a.JellyfinApiKey, a.PlexAddress, a.PlexApiKey, session, opts); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
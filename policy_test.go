@@ -0,0 +1,177 @@
+package jellyplexgatherer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Janczykkkko/jellyplexgatherer/testserver"
+)
+
+type recordAction struct {
+	violations *[]PolicyViolation
+}
+
+func (a recordAction) Execute(violation PolicyViolation) error {
+	*a.violations = append(*a.violations, violation)
+	return nil
+}
+
+func sessionIDs(sessions []SessionData) (ids []string) {
+	for _, session := range sessions {
+		ids = append(ids, session.SessionID)
+	}
+	return ids
+}
+
+func TestPolicyGracePeriod(t *testing.T) {
+	var warned, enforced []PolicyViolation
+	engine := NewPolicyEngine(Policy{
+		Rule:        MaxStreamsRule{Max: 1},
+		GracePeriod: time.Minute,
+		Warn:        []PolicyAction{recordAction{&warned}},
+		Enforce:     []PolicyAction{recordAction{&enforced}},
+	})
+	sessions := []SessionData{
+		{Service: "Jellyfin", SessionID: "j1", UserName: "alice"},
+		{Service: "Plex", SessionID: "p1", UserName: "Alice"},
+	}
+
+	start := time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC)
+	for _, offset := range []time.Duration{0, 30 * time.Second, time.Minute, 2 * time.Minute} {
+		if violations := engine.evaluate(sessions, start.Add(offset)); len(violations) != 1 {
+			t.Fatalf("got %d violations after %s, want 1", len(violations), offset)
+		}
+		wantEnforced := 0
+		if offset >= time.Minute {
+			wantEnforced = 1
+		}
+		if len(warned) != 1 || len(enforced) != wantEnforced {
+			t.Fatalf("after %s: %d warnings and %d enforcements, want 1 and %d", offset, len(warned), len(enforced), wantEnforced)
+		}
+	}
+
+	// The violation going away resets the grace period
+	engine.evaluate(sessions[:1], start.Add(3*time.Minute))
+	engine.evaluate(sessions, start.Add(4*time.Minute))
+	if len(warned) != 2 || len(enforced) != 1 {
+		t.Errorf("got %d warnings and %d enforcements after the violation came back, want 2 and 1", len(warned), len(enforced))
+	}
+}
+
+func TestMaxStreamsTargetsNewest(t *testing.T) {
+	var enforced []PolicyViolation
+	engine := NewPolicyEngine(Policy{
+		Rule:    MaxStreamsRule{Max: 1},
+		Enforce: []PolicyAction{recordAction{&enforced}},
+	})
+	old := SessionData{Service: "Plex", SessionID: "p1", UserName: "alice"}
+	newer := SessionData{Service: "Jellyfin", SessionID: "j1", UserName: "alice"}
+
+	start := time.Now()
+	engine.evaluate([]SessionData{old}, start)
+	// GetAllSessions lists Jellyfin first, the Plex stream is still the older one
+	engine.evaluate([]SessionData{newer, old}, start.Add(time.Minute))
+	if len(enforced) != 1 {
+		t.Fatalf("got %d enforcements, want 1", len(enforced))
+	}
+	if got := sessionIDs(enforced[0].Sessions); !reflect.DeepEqual(got, []string{"j1"}) {
+		t.Errorf("targeted %v, want the newest stream j1", got)
+	}
+}
+
+func TestPolicyRules(t *testing.T) {
+	sessions := []SessionData{
+		{SessionID: "1", UserName: "alice", IPAddress: "203.0.113.1"},
+		{SessionID: "2", UserName: "alice", IPAddress: "203.0.113.1"},
+		{SessionID: "3", UserName: "alice", IPAddress: "198.51.100.9"},
+		{SessionID: "4", UserName: "bob", IPAddress: "192.168.1.5", PlayMethod: "Transcode", VideoHeight: 2160, Location: LocationLAN},
+		{SessionID: "5", UserName: "carol", IPAddress: "198.51.100.20", PlayMethod: "Transcode", VideoHeight: 2160, Location: LocationWAN},
+		{SessionID: "6", UserName: "dave", IPAddress: "198.51.100.30", PlayMethod: "Transcode", VideoHeight: 720, Location: LocationWAN},
+	}
+	tests := []struct {
+		rule PolicyRule
+		want [][]string
+	}{
+		{MaxStreamsRule{Max: 2}, [][]string{{"3"}}},
+		{MaxIPsRule{Max: 1}, [][]string{{"3"}}},
+		{RemoteTranscodeRule{MaxHeight: 1080}, [][]string{{"5"}}},
+	}
+	for _, test := range tests {
+		var got [][]string
+		for _, violation := range test.rule.Evaluate(sessions) {
+			got = append(got, sessionIDs(violation.Sessions))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s targeted %v, want %v", test.rule.Name(), got, test.want)
+		}
+	}
+}
+
+func TestMaxIPsRuleAddresses(t *testing.T) {
+	sessions := []SessionData{
+		// One household, the LAN and relayed streams share the public address
+		{SessionID: "1", UserName: "alice", IPAddress: "192.168.1.5", PublicAddress: "203.0.113.1"},
+		{SessionID: "2", UserName: "alice", IPAddress: "10.99.0.2", PublicAddress: "203.0.113.1"},
+		{SessionID: "3", UserName: "alice", IPAddress: "203.0.113.1:51234"},
+		// No address at all doesn't count as another one
+		{SessionID: "4", UserName: "alice"},
+		{SessionID: "5", UserName: "bob", IPAddress: "198.51.100.7"},
+		{SessionID: "6", UserName: "bob", IPAddress: ""},
+		{SessionID: "7", UserName: "bob", IPAddress: "[2001:db8::2b]:8096"},
+	}
+	violations := MaxIPsRule{Max: 1}.Evaluate(sessions)
+	if len(violations) != 1 || violations[0].UserName != "bob" || !reflect.DeepEqual(sessionIDs(violations[0].Sessions), []string{"7"}) {
+		t.Fatalf("unexpected violations %+v", violations)
+	}
+	if reason := violations[0].Reason; reason != "streaming from 2 addresses (198.51.100.7, 2001:db8::2b), limit is 1" {
+		t.Errorf("unexpected reason %q", reason)
+	}
+}
+
+func TestPolicyActionsRunUnlocked(t *testing.T) {
+	var engine *PolicyEngine
+	engine = NewPolicyEngine(Policy{
+		Rule: MaxStreamsRule{Max: 0},
+		Warn: []PolicyAction{NotifyAction(func(PolicyViolation) error {
+			// Would deadlock if actions ran under the engine's lock
+			engine.Evaluate(nil)
+			return nil
+		})},
+	})
+	done := make(chan struct{})
+	go func() {
+		engine.Evaluate([]SessionData{{SessionID: "1", UserName: "alice"}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("policy action deadlocked")
+	}
+}
+
+func TestTerminateAction(t *testing.T) {
+	jellyfin := testserver.NewJellyfin("jellykey")
+	defer jellyfin.Close()
+	second := alice
+	second.ID, second.DeviceID, second.DeviceName = "s4", "d4", "Phone"
+	jellyfin.SetSessions(alice, second)
+
+	engine := NewPolicyEngine(Policy{
+		Rule:    MaxStreamsRule{Max: 1},
+		Enforce: []PolicyAction{TerminateAction{JellyfinAddress: jellyfin.URL, JellyfinApiKey: "jellykey"}},
+	})
+	watcher := NewSessionWatcher(jellyfin.URL, "jellykey", "", "", 0)
+	events, cancel := watcher.Subscribe(0)
+	defer cancel()
+	watcher.Poll()
+	for len(events) > 0 {
+		if event := <-events; event.Type == EventSnapshot {
+			engine.Evaluate(event.Sessions)
+		}
+	}
+	if stopped := jellyfin.Stopped(); len(stopped) != 1 {
+		t.Errorf("stopped %v, want one of alice's two streams", stopped)
+	}
+}
@@ -0,0 +1,84 @@
+package jellyplexgatherer
+
+import (
+	"strings"
+)
+
+// Provider names used as keys in ProviderIDs maps
+const (
+	ProviderIMDb = "imdb"
+	ProviderTMDb = "tmdb"
+	ProviderTVDb = "tvdb"
+)
+
+// Order in which providers identify a title, IMDb ids are unique across types so they go first
+var providerPrecedence = []string{ProviderIMDb, ProviderTMDb, ProviderTVDb}
+
+// Plex agents spell providers in several ways depending on the agent generation
+var plexGuidProviders = map[string]string{
+	"imdb":                               ProviderIMDb,
+	"tmdb":                               ProviderTMDb,
+	"tvdb":                               ProviderTVDb,
+	"com.plexapp.agents.imdb":            ProviderIMDb,
+	"com.plexapp.agents.themoviedb":      ProviderTMDb,
+	"com.plexapp.agents.thetvdb":         ProviderTVDb,
+	"com.plexapp.agents.thetvdbdvdorder": ProviderTVDb,
+}
+
+// Parse a Plex guid like "imdb://tt0133093" (new agents, from <Guid> children) or
+// "com.plexapp.agents.imdb://tt0133093?lang=en" (legacy agents). Plex's own "plex://movie/..."
+// ids and legacy TVDb episode paths ("thetvdb://12345/1/3") don't map to a provider id.
+func parsePlexGuid(guid string) (provider, id string, ok bool) {
+	scheme, rest, found := strings.Cut(guid, "://")
+	if !found {
+		return "", "", false
+	}
+	provider, ok = plexGuidProviders[scheme]
+	if !ok {
+		return "", "", false
+	}
+	id, _, _ = strings.Cut(rest, "?")
+	if strings.Contains(id, "/") || id == "" {
+		return "", "", false
+	}
+	return provider, id, true
+}
+
+// Collect provider ids from a Plex item's guid attribute and <Guid> children
+func plexProviderIDs(guids ...string) map[string]string {
+	ids := make(map[string]string)
+	for _, guid := range guids {
+		if provider, id, ok := parsePlexGuid(guid); ok {
+			ids[provider] = id
+		}
+	}
+	return ids
+}
+
+// Normalize Jellyfin's ProviderIds ({"Imdb": "tt0133093", "Tmdb": "603"}) to lower case provider names
+func jellyProviderIDs(providerIDs map[string]string) map[string]string {
+	ids := make(map[string]string)
+	for provider, id := range providerIDs {
+		if id != "" {
+			ids[strings.ToLower(provider)] = id
+		}
+	}
+	return ids
+}
+
+// Keys under which an item can be matched across servers. TMDb and TVDb reuse numbers
+// between movies, shows and episodes so their keys include the item type, IMDb ids are unique.
+func providerMatchKeys(itemType string, ids map[string]string) (keys []string) {
+	for _, provider := range providerPrecedence {
+		id, ok := ids[provider]
+		if !ok {
+			continue
+		}
+		if provider == ProviderIMDb {
+			keys = append(keys, provider+":"+id)
+		} else {
+			keys = append(keys, provider+":"+itemType+":"+id)
+		}
+	}
+	return keys
+}
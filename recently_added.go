@@ -0,0 +1,166 @@
+package jellyplexgatherer
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RecentlyAddedEntry is one title in the merged feed, with a copy per server that has it
+type RecentlyAddedEntry struct {
+	Type        string
+	Title       string
+	SeriesTitle string
+	Season      int
+	Episode     int
+	Year        int
+	ProviderIDs map[string]string
+	AddedAt     time.Time // latest time any server added it
+	Available   []LibraryItem
+}
+
+// AvailableOn reports whether the title exists on the given service ("Plex" or "Jellyfin")
+func (e RecentlyAddedEntry) AvailableOn(service string) bool {
+	for _, item := range e.Available {
+		if item.Service == service {
+			return true
+		}
+	}
+	return false
+}
+
+// Get recently added movies, episodes and tracks from every configured server, merged by title,
+// newest first. A limit of 0 or less returns everything.
+func GetRecentlyAddedFeed(jellyfinAddress, jellyfinApiKey, plexAddress, plexApiKey string, limit int) (feed []RecentlyAddedEntry, errors string) {
+	var items []LibraryItem
+	if jellyfinAddress != "" || jellyfinApiKey != "" {
+		jellyItems, err := GetJellyRecentlyAdded(jellyfinAddress, jellyfinApiKey, limit)
+		if err != nil {
+			errors = fmt.Sprintf("Error getting Jellyfin recently added: %s", err)
+		}
+		items = append(items, jellyItems...)
+	}
+	if plexAddress != "" || plexApiKey != "" {
+		plexItems, err := GetPlexRecentlyAdded(plexAddress, plexApiKey, limit)
+		if err != nil {
+			errors = errors + "\n" + fmt.Sprintf("Error getting Plex recently added: %s", err)
+		}
+		items = append(items, plexItems...)
+	}
+	feed = MergeRecentlyAdded(items)
+	if limit > 0 && len(feed) > limit {
+		feed = feed[:limit]
+	}
+	return feed, errors
+}
+
+// Newest movies, episodes and tracks across all Jellyfin libraries
+func GetJellyRecentlyAdded(jellyfinAddress, jellyfinApiKey string, limit int) (items []LibraryItem, err error) {
+	return getJellyRecentlyAdded(jellyfinAddress, jellyfinApiKey, "", "", limit)
+}
+
+// Newest movies, episodes and tracks across all Plex libraries. Plex's own recentlyAdded endpoints
+// group episodes into seasons and tracks into albums, so sections are listed by addedAt instead.
+func GetPlexRecentlyAdded(plexAddress, plexApiKey string, limit int) (items []LibraryItem, err error) {
+	var sections plexSections
+	if err := getXML("plex", plexAddress+"/library/sections?X-Plex-Token="+plexApiKey, &sections); err != nil {
+		return nil, err
+	}
+	for _, section := range sections.Directory {
+		var itemType string
+		switch section.Type {
+		case "movie":
+			itemType = plexTypeNumbers["movie"]
+		case "show":
+			itemType = plexTypeNumbers["episode"]
+		case "artist":
+			itemType = plexTypeNumbers["track"]
+		default:
+			continue
+		}
+		query := url.Values{}
+		query.Set("type", itemType)
+		query.Set("sort", "addedAt:desc")
+		query.Set("includeGuids", "1")
+		if limit > 0 {
+			query.Set("X-Plex-Container-Start", "0")
+			query.Set("X-Plex-Container-Size", strconv.Itoa(limit))
+		}
+		query.Set("X-Plex-Token", plexApiKey)
+		var container plexLibraryItems
+		if err := getXML("plex", fmt.Sprintf("%s/library/sections/%s/all?%s", plexAddress, section.Key, query.Encode()), &container); err != nil {
+			return nil, fmt.Errorf("fetching recently added in plex library %s: %w", section.Title, err)
+		}
+		for _, item := range container.Items {
+			items = append(items, plexLibraryItemData(item, section.Title))
+		}
+	}
+	return items, nil
+}
+
+// MergeRecentlyAdded collapses copies of the same title on different servers into one entry.
+// Items are matched like MediaRef.Matches: provider ids both sides have must all agree, only
+// when neither side has ids they fall back to title and year, series, season and episode for
+// episodes or artist and title for tracks.
+func MergeRecentlyAdded(items []LibraryItem) []RecentlyAddedEntry {
+	var entries []*RecentlyAddedEntry
+	for _, item := range items {
+		ref := item.mediaRef()
+		var entry *RecentlyAddedEntry
+		for _, candidate := range entries {
+			if candidate.mediaRef().Matches(ref) {
+				entry = candidate
+				break
+			}
+		}
+		if entry == nil {
+			entry = &RecentlyAddedEntry{
+				Type:        item.Type,
+				Title:       item.Title,
+				SeriesTitle: item.SeriesTitle,
+				Season:      item.Season,
+				Episode:     item.Episode,
+				Year:        item.Year,
+				ProviderIDs: make(map[string]string),
+			}
+			entries = append(entries, entry)
+		}
+		entry.Available = append(entry.Available, item)
+		if item.AddedAt.After(entry.AddedAt) {
+			entry.AddedAt = item.AddedAt
+		}
+		for provider, id := range item.ProviderIDs {
+			if _, ok := entry.ProviderIDs[provider]; !ok {
+				entry.ProviderIDs[provider] = id
+			}
+		}
+	}
+
+	feed := make([]RecentlyAddedEntry, 0, len(entries))
+	for _, entry := range entries {
+		feed = append(feed, *entry)
+	}
+	sort.SliceStable(feed, func(i, j int) bool {
+		return feed[i].AddedAt.After(feed[j].AddedAt)
+	})
+	return feed
+}
+
+func (e RecentlyAddedEntry) mediaRef() MediaRef {
+	return MediaRef{Type: e.Type, Title: e.Title, Series: e.SeriesTitle, Season: e.Season, Episode: e.Episode, Year: e.Year, ProviderIDs: e.ProviderIDs}
+}
+
+func titleMatchKey(item LibraryItem) string {
+	switch item.Type {
+	case "episode":
+		// The air year tells remakes like The Office (UK) and (US) apart
+		return fmt.Sprintf("title:episode:%s:%d:%d:%d", strings.ToLower(item.SeriesTitle), item.Year, item.Season, item.Episode)
+	case "track":
+		// Tracks carry their album's year on some servers and none on others
+		return fmt.Sprintf("title:track:%s:%s", strings.ToLower(item.SeriesTitle), strings.ToLower(item.Title))
+	}
+	return fmt.Sprintf("title:%s:%s:%d", item.Type, strings.ToLower(item.Title), item.Year)
+}
@@ -0,0 +1,115 @@
+package jellyplexgatherer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestMergeRecentlyAdded(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	items := []LibraryItem{
+		{Service: "Jellyfin", Type: "movie", Title: "Heat", Year: 1995, AddedAt: day, ProviderIDs: map[string]string{"imdb": "tt0113277"}},
+		{Service: "Plex", Type: "movie", Title: "Heat (1995)", Year: 1995, AddedAt: day.Add(time.Hour), ProviderIDs: map[string]string{"imdb": "tt0113277", "tmdb": "949"}},
+		// Same title and year but the ids say it's a different film, and one copy without ids
+		{Service: "Plex", Type: "movie", Title: "Crash", Year: 2004, AddedAt: day, ProviderIDs: map[string]string{"tmdb": "1640"}},
+		{Service: "Jellyfin", Type: "movie", Title: "Crash", Year: 2004, AddedAt: day, ProviderIDs: map[string]string{"tmdb": "99999"}},
+		{Service: "Jellyfin", Type: "movie", Title: "Crash", Year: 2004, AddedAt: day},
+		// Remakes share season and episode numbers
+		{Service: "Plex", Type: "episode", Title: "Pilot", SeriesTitle: "The Office", Season: 1, Episode: 1, Year: 2005, AddedAt: day},
+		{Service: "Jellyfin", Type: "episode", Title: "Downsize", SeriesTitle: "The Office", Season: 1, Episode: 1, Year: 2001, AddedAt: day},
+		{Service: "Jellyfin", Type: "episode", Title: "Pilot", SeriesTitle: "The Office", Season: 1, Episode: 1, Year: 2005, AddedAt: day},
+		// Tracks without ids match on artist and title
+		{Service: "Plex", Type: "track", Title: "Teardrop", SeriesTitle: "Massive Attack", AddedAt: day.Add(2 * time.Hour)},
+		{Service: "Jellyfin", Type: "track", Title: "Teardrop", SeriesTitle: "Massive Attack", Year: 1998, AddedAt: day},
+	}
+
+	feed := MergeRecentlyAdded(items)
+	if len(feed) != 7 {
+		t.Fatalf("got %d entries, want 7: %+v", len(feed), feed)
+	}
+	if feed[0].Type != "track" || len(feed[0].Available) != 2 {
+		t.Errorf("tracks weren't merged or sorted first: %+v", feed[0])
+	}
+	heat := feed[1]
+	if heat.Title != "Heat" || !heat.AvailableOn("Plex") || !heat.AvailableOn("Jellyfin") || heat.ProviderIDs["tmdb"] != "949" || !heat.AddedAt.Equal(day.Add(time.Hour)) {
+		t.Errorf("unexpected merged movie %+v", heat)
+	}
+	for _, entry := range feed[2:] {
+		if entry.Type == "episode" && entry.Year == 2005 {
+			if len(entry.Available) != 2 {
+				t.Errorf("US episode not merged: %+v", entry)
+			}
+		} else if len(entry.Available) != 1 {
+			t.Errorf("merged different titles: %+v", entry)
+		}
+	}
+}
+
+func TestRecentlyAddedLimit(t *testing.T) {
+	var queries []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		switch r.URL.Path {
+		case "/Items":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"Items":[{"Id":"1","Name":"Teardrop","Type":"Audio","AlbumArtist":"Massive Attack"}]}`))
+		case "/library/sections":
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(`<MediaContainer><Directory key="3" type="artist" title="Music"/><Directory key="4" type="photo" title="Photos"/></MediaContainer>`))
+		default:
+			w.Header().Set("Content-Type", "text/xml")
+			w.Write([]byte(`<MediaContainer><Track ratingKey="7" type="track" title="Teardrop" grandparentTitle="Massive Attack"/></MediaContainer>`))
+		}
+	}))
+	defer server.Close()
+
+	feed, errors := GetRecentlyAddedFeed(server.URL, "key", server.URL, "token", 0)
+	if errors != "" {
+		t.Fatal(errors)
+	}
+	if len(feed) != 1 || len(feed[0].Available) != 2 {
+		t.Errorf("want the track from both servers, got %+v", feed)
+	}
+	if len(queries) != 3 {
+		t.Fatalf("made %d requests, want 3", len(queries))
+	}
+	for _, query := range queries {
+		for _, param := range []string{"Limit", "X-Plex-Container-Size"} {
+			if query.Has(param) {
+				t.Errorf("sent %s without a limit: %v", param, query)
+			}
+		}
+	}
+	if queries[2].Get("type") != plexTypeNumbers["track"] {
+		t.Errorf("listed plex music as type %s", queries[2].Get("type"))
+	}
+
+	queries = nil
+	GetRecentlyAddedFeed(server.URL, "key", server.URL, "token", 5)
+	if queries[0].Get("Limit") != "5" || queries[2].Get("X-Plex-Container-Size") != "5" {
+		t.Errorf("limit not sent: %v", queries)
+	}
+}
+
+func TestMergeRecentlyAddedConflictingIDs(t *testing.T) {
+	// The imdb ids agree but tmdb says these are different films, as MediaRef.Matches does
+	items := []LibraryItem{
+		{Service: "Plex", Type: "movie", Title: "Heat", Year: 1995, ProviderIDs: map[string]string{"imdb": "tt0113277", "tmdb": "949"}},
+		{Service: "Jellyfin", Type: "movie", Title: "Heat", Year: 1995, ProviderIDs: map[string]string{"imdb": "tt0113277", "tmdb": "1"}},
+		{Service: "Jellyfin", Type: "movie", Title: "Heat", Year: 1995, ProviderIDs: map[string]string{"tmdb": "949"}},
+	}
+	feed := MergeRecentlyAdded(items)
+	if len(feed) != 2 || len(feed[0].Available) != 2 || feed[0].Available[1].ProviderIDs["tmdb"] != "949" {
+		t.Errorf("unexpected feed %+v", feed)
+	}
+	for _, entry := range feed {
+		for _, item := range entry.Available[1:] {
+			if !entry.Available[0].mediaRef().Matches(item.mediaRef()) {
+				t.Errorf("merged %+v with %+v", entry.Available[0], item)
+			}
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package jellyplexgatherer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker open, server is failing")
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// RetryPolicy says how often and how patiently to retry a failed GET. Zero fields use defaults.
+type RetryPolicy struct {
+	MaxAttempts     int           // attempts including the first, default 3, 1 disables retries
+	InitialBackoff  time.Duration // default 500ms
+	MaxBackoff      time.Duration // default 10s, also caps Retry-After
+	Multiplier      float64       // default 2
+	Jitter          float64       // random +/- fraction of each backoff, default 0.2
+	RetryableStatus []int         // default 429, 502, 503, 504
+}
+
+// BreakerPolicy says when to stop hitting a failing server. Zero fields use defaults.
+type BreakerPolicy struct {
+	FailureThreshold int           // consecutive failed requests before opening, default 5
+	ProbeInterval    time.Duration // how long to wait before letting a probe request through, default 30s
+}
+
+// ServerHealth is the breaker state of one server, e.g. for a "Plex down since 10:42" banner
+type ServerHealth struct {
+	Server              string // host:port
+	State               string // CircuitClosed, CircuitOpen or CircuitHalfOpen
+	ConsecutiveFailures int
+	LastError           string
+	LastSuccess         time.Time
+	DownSince           time.Time // zero while the circuit is closed
+	NextProbe           time.Time // zero while the circuit is closed
+}
+
+// ResilientTransport retries idempotent requests with exponential backoff and jitter and keeps
+// a circuit breaker per server, failing fast while a server is down and probing it every
+// ProbeInterval. Only GET and HEAD are retried and session control requests are always sent
+// once, including Plex's terminate which is a GET.
+//
+//	jellyplexgatherer.HTTPClient = &http.Client{Transport: jellyplexgatherer.NewResilientTransport(nil)}
+type ResilientTransport struct {
+	Transport http.RoundTripper // nil uses http.DefaultTransport
+	Retry     RetryPolicy
+	Breaker   BreakerPolicy
+	Servers   map[string]RetryPolicy // per server (host:port) overrides of Retry
+
+	mu      sync.Mutex
+	servers map[string]*ServerHealth
+	probing map[string]bool
+	sleep   func(context.Context, time.Duration) error
+}
+
+func NewResilientTransport(transport http.RoundTripper) *ResilientTransport {
+	return &ResilientTransport{
+		Transport: transport,
+		Servers:   make(map[string]RetryPolicy),
+	}
+}
+
+// Health returns the breaker state of every server seen so far, sorted by server
+func (t *ResilientTransport) Health() []ServerHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	health := make([]ServerHealth, 0, len(t.servers))
+	for _, server := range t.servers {
+		health = append(health, *server)
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].Server < health[j].Server })
+	return health
+}
+
+func (t *ResilientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	server := req.URL.Host
+	if err := t.allow(server, time.Now()); err != nil {
+		return nil, err
+	}
+
+	policy := t.policy(server)
+	attempts := policy.MaxAttempts
+	if req.Method != http.MethodGet && req.Method != http.MethodHead || req.Context().Value(noRetryKey{}) != nil {
+		attempts = 1
+	}
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	var resp *http.Response
+	var err error
+	for attempt := 1; ; attempt++ {
+		resp, err = transport.RoundTrip(req)
+		if attempt >= attempts || !policy.retryable(resp, err) || req.Context().Err() != nil {
+			break
+		}
+		wait := policy.backoff(attempt, resp)
+		logger().Warn("retrying media server request", "server", server, "attempt", attempt, "wait", wait, "error", requestError(resp, err))
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if err := t.wait(req.Context(), wait); err != nil {
+			t.release(server)
+			return nil, err
+		}
+	}
+
+	// The caller gave up, that says nothing about the server
+	if err != nil && req.Context().Err() != nil {
+		t.release(server)
+		return nil, err
+	}
+	if err != nil || resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		t.record(server, time.Now(), requestError(resp, err))
+	} else {
+		t.record(server, time.Now(), nil)
+	}
+	return resp, err
+}
+
+type noRetryKey struct{}
+
+// Mark a request as not safe to repeat, the transport sends it once whatever its method
+func withoutRetries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetryKey{}, true)
+}
+
+func (t *ResilientTransport) policy(server string) RetryPolicy {
+	policy, ok := t.Servers[server]
+	if !ok {
+		policy = t.Retry
+	}
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 3
+	}
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = 500 * time.Millisecond
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = 10 * time.Second
+	}
+	if policy.Multiplier < 1 {
+		policy.Multiplier = 2
+	}
+	if policy.Jitter <= 0 {
+		policy.Jitter = 0.2
+	}
+	if policy.RetryableStatus == nil {
+		policy.RetryableStatus = []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	return policy
+}
+
+func (p RetryPolicy) retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	for _, status := range p.RetryableStatus {
+		if resp.StatusCode == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Exponential backoff with jitter, a Retry-After header from the server wins if it's longer
+func (p RetryPolicy) backoff(attempt int, resp *http.Response) time.Duration {
+	wait := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt-1))
+	wait *= 1 + p.Jitter*(2*rand.Float64()-1)
+	backoff := time.Duration(min(wait, float64(p.MaxBackoff)))
+	if resp != nil {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			backoff = max(backoff, min(time.Duration(seconds)*time.Second, p.MaxBackoff))
+		}
+	}
+	return backoff
+}
+
+func (t *ResilientTransport) wait(ctx context.Context, d time.Duration) error {
+	if t.sleep != nil {
+		return t.sleep(ctx, d)
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Fail fast while the circuit is open, let a single probe through once ProbeInterval passed
+func (t *ResilientTransport) allow(server string, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	health := t.health(server)
+	switch health.State {
+	case CircuitOpen:
+		if now.Before(health.NextProbe) {
+			return fmt.Errorf("%w: %s down since %s (%s)", ErrCircuitOpen, server, health.DownSince.Format(time.Kitchen), health.LastError)
+		}
+		health.State = CircuitHalfOpen
+		t.probing[server] = true
+	case CircuitHalfOpen:
+		if t.probing[server] {
+			return fmt.Errorf("%w: %s down since %s, probe in progress", ErrCircuitOpen, server, health.DownSince.Format(time.Kitchen))
+		}
+		t.probing[server] = true
+	}
+	return nil
+}
+
+func (t *ResilientTransport) record(server string, now time.Time, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	health := t.health(server)
+	delete(t.probing, server)
+	if err == nil {
+		if health.State != CircuitClosed {
+			logger().Info("media server recovered", "server", server, "down_since", health.DownSince)
+		}
+		*health = ServerHealth{Server: server, State: CircuitClosed, LastSuccess: now}
+		return
+	}
+
+	threshold := t.Breaker.FailureThreshold
+	if threshold <= 0 {
+		threshold = 5
+	}
+	interval := t.Breaker.ProbeInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	health.ConsecutiveFailures++
+	health.LastError = err.Error()
+	if health.State == CircuitHalfOpen || health.ConsecutiveFailures >= threshold {
+		if health.State == CircuitClosed {
+			health.DownSince = now
+			logger().Warn("media server circuit opened", "server", server, "failures", health.ConsecutiveFailures, "error", err)
+		}
+		health.State = CircuitOpen
+		health.NextProbe = now.Add(interval)
+	}
+}
+
+// Finish a request without counting it either way, a half-open circuit lets the next probe through
+func (t *ResilientTransport) release(server string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.probing, server)
+}
+
+func (t *ResilientTransport) health(server string) *ServerHealth {
+	if t.servers == nil {
+		t.servers = make(map[string]*ServerHealth)
+		t.probing = make(map[string]bool)
+	}
+	health, ok := t.servers[server]
+	if !ok {
+		health = &ServerHealth{Server: server, State: CircuitClosed}
+		t.servers[server] = health
+	}
+	return health
+}
+
+func requestError(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("server returned %s", resp.Status)
+}
@@ -0,0 +1,176 @@
+package jellyplexgatherer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Janczykkkko/jellyplexgatherer/testserver"
+)
+
+func unavailableServer(t *testing.T) (*httptest.Server, *int32) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(server.Close)
+	return server, &hits
+}
+
+func useTransport(t *testing.T, transport *ResilientTransport) {
+	client := HTTPClient
+	t.Cleanup(func() { HTTPClient = client })
+	HTTPClient = &http.Client{Transport: transport}
+}
+
+func TestResilientTransportRetries(t *testing.T) {
+	server, hits := unavailableServer(t)
+	transport := NewResilientTransport(nil)
+	transport.sleep = func(context.Context, time.Duration) error { return nil }
+	useTransport(t, transport)
+
+	resp, err := HTTPClient.Get(server.URL + "/Sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if *hits != 3 {
+		t.Errorf("GET was sent %d times, want 3", *hits)
+	}
+
+	// Plex terminates with a GET, it must not be repeated
+	atomic.StoreInt32(hits, 0)
+	KillPlexSession(server.URL, "token", "s1", KillOptions{Reason: "bye"})
+	if *hits != 1 {
+		t.Errorf("terminate was sent %d times, want once", *hits)
+	}
+}
+
+func TestResilientTransportCancelledWait(t *testing.T) {
+	server, _ := unavailableServer(t)
+	transport := NewResilientTransport(nil)
+	transport.Breaker.FailureThreshold = 1
+	transport.sleep = func(ctx context.Context, d time.Duration) error { return context.Canceled }
+	useTransport(t, transport)
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/Sessions", nil)
+	if _, err := HTTPClient.Do(req); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	health := transport.Health()
+	if len(health) != 1 || health[0].State != CircuitClosed || health[0].ConsecutiveFailures != 0 {
+		t.Errorf("a cancelled request counted against the server: %+v", health)
+	}
+}
+
+func TestResilientTransportBreaker(t *testing.T) {
+	plex := testserver.NewPlex("plextoken")
+	defer plex.Close()
+	unavailable := testserver.Step{Status: http.StatusServiceUnavailable, Body: "library scan in progress"}
+	plex.Play(unavailable, unavailable, testserver.Step{Sessions: []testserver.Session{bob}})
+
+	transport := NewResilientTransport(nil)
+	transport.Retry = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	transport.Breaker = BreakerPolicy{FailureThreshold: 2, ProbeInterval: time.Hour}
+	var waits []time.Duration
+	transport.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	useTransport(t, transport)
+
+	sessions, err := GetPlexSessions(plex.URL, "plextoken")
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("got %d sessions, %v after retries", len(sessions), err)
+	}
+	if plex.Polls() != 3 || len(waits) != 2 {
+		t.Errorf("got %d polls and %d waits, want 3 and 2", plex.Polls(), len(waits))
+	}
+
+	plex.Play(unavailable)
+	for i := 0; i < 2; i++ {
+		if _, err := GetPlexSessions(plex.URL, "plextoken"); err == nil {
+			t.Fatal("expected an error from a failing server")
+		}
+	}
+	health := transport.Health()
+	if len(health) != 1 || health[0].State != CircuitOpen || health[0].DownSince.IsZero() {
+		t.Fatalf("unexpected health after repeated failures: %+v", health)
+	}
+	polls := plex.Polls()
+	if _, err := GetPlexSessions(plex.URL, "plextoken"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("got %v with an open circuit, want %v", err, ErrCircuitOpen)
+	}
+	if plex.Polls() != polls {
+		t.Error("open circuit still hit the server")
+	}
+
+	// Once the probe interval passed a single request goes through and closes the circuit
+	plex.SetSessions(bob)
+	transport.mu.Lock()
+	transport.servers[health[0].Server].NextProbe = time.Now()
+	transport.mu.Unlock()
+	if _, err := GetPlexSessions(plex.URL, "plextoken"); err != nil {
+		t.Fatalf("probe failed: %v", err)
+	}
+	if health := transport.Health(); health[0].State != CircuitClosed || health[0].ConsecutiveFailures != 0 {
+		t.Errorf("circuit didn't close after a successful probe: %+v", health)
+	}
+}
+
+func TestResilientTransportServerOverrides(t *testing.T) {
+	flaky, flakyHits := unavailableServer(t)
+	other, otherHits := unavailableServer(t)
+	transport := NewResilientTransport(nil)
+	transport.Retry = RetryPolicy{MaxAttempts: 2}
+	transport.Servers[strings.TrimPrefix(flaky.URL, "http://")] = RetryPolicy{MaxAttempts: 4}
+	transport.sleep = func(context.Context, time.Duration) error { return nil }
+	useTransport(t, transport)
+
+	for _, server := range []*httptest.Server{flaky, other} {
+		resp, err := HTTPClient.Get(server.URL + "/Sessions")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if *flakyHits != 4 || *otherHits != 2 {
+		t.Errorf("got %d and %d attempts, want 4 for the overridden server and 2 for the other", *flakyHits, *otherHits)
+	}
+}
+
+func TestResilientTransportRetryAfter(t *testing.T) {
+	var retryAfter atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", retryAfter.Load().(string))
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	transport := NewResilientTransport(nil)
+	transport.Retry = RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Second}
+	var waits []time.Duration
+	transport.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	useTransport(t, transport)
+
+	// A longer Retry-After wins over the backoff, up to MaxBackoff
+	for _, seconds := range []string{"2", "3600"} {
+		retryAfter.Store(seconds)
+		resp, err := HTTPClient.Get(server.URL + "/status/sessions")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if len(waits) != 2 || waits[0] != 2*time.Second || waits[1] != 5*time.Second {
+		t.Errorf("waited %v, want 2s for Retry-After 2 and 5s capped for 3600", waits)
+	}
+}
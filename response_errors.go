@@ -0,0 +1,122 @@
+package jellyplexgatherer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrUnauthorized          = errors.New("unauthorized, check the api key or token")
+	ErrNotFound              = errors.New("endpoint not found")
+	ErrServerError           = errors.New("server error")
+	ErrUnexpectedContentType = errors.New("unexpected content type")
+)
+
+// How much of an error response body is kept for the error message
+const errorBodySnippet = 256
+
+// StatusError is a non-2xx response from Plex or Jellyfin. It matches ErrUnauthorized,
+// ErrNotFound or ErrServerError with errors.Is depending on the status code.
+type StatusError struct {
+	Backend    string // "jellyfin", "plex" or "plex.tv"
+	Endpoint   string
+	StatusCode int
+	Status     string
+	Body       string // start of the response body
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("%s %s returned %s", e.Backend, e.Endpoint, e.Status)
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+func (e *StatusError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden:
+		return ErrUnauthorized
+	case e.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case e.StatusCode >= 500:
+		return ErrServerError
+	}
+	return nil
+}
+
+// ContentTypeError is a 2xx response in a format the fetcher can't decode, typically an
+// HTML login or error page from a reverse proxy in front of the server
+type ContentTypeError struct {
+	Backend     string
+	Endpoint    string
+	ContentType string
+	Body        string
+}
+
+func (e *ContentTypeError) Error() string {
+	msg := fmt.Sprintf("%s %s returned content type %q", e.Backend, e.Endpoint, e.ContentType)
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+func (e *ContentTypeError) Unwrap() error {
+	return ErrUnexpectedContentType
+}
+
+// Check the status and content type of a response before decoding it. body may be nil when
+// the caller streams the response, the snippet is then read from resp.Body. A missing
+// Content-Type header is accepted, some proxies strip it.
+func checkResponse(backend, endpoint string, resp *http.Response, body []byte, mediaTypes ...string) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{
+			Backend:    backend,
+			Endpoint:   endpoint,
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       bodySnippet(resp, body),
+		}
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" || len(mediaTypes) == 0 {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil {
+		for _, want := range mediaTypes {
+			if mediaType == want {
+				return nil
+			}
+		}
+	}
+	return &ContentTypeError{Backend: backend, Endpoint: endpoint, ContentType: contentType, Body: bodySnippet(resp, body)}
+}
+
+func bodySnippet(resp *http.Response, body []byte) string {
+	if body == nil {
+		body, _ = io.ReadAll(io.LimitReader(resp.Body, errorBodySnippet))
+	}
+	if len(body) > errorBodySnippet {
+		body = body[:errorBodySnippet]
+		for len(body) > 0 && !utf8.Valid(body) {
+			body = body[:len(body)-1]
+		}
+	}
+	return strings.Join(strings.Fields(string(body)), " ")
+}
+
+// The path of a request url, without the query that carries the token
+func endpointPath(rawURL string) string {
+	if parsed, err := url.Parse(rawURL); err == nil {
+		return parsed.Path
+	}
+	return ""
+}
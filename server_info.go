@@ -0,0 +1,239 @@
+package jellyplexgatherer
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ServerInfo identifies a server, so an empty session list can be told apart from a wrong address
+type ServerInfo struct {
+	Service           string
+	Address           string
+	ServerName        string
+	Version           string
+	MachineIdentifier string
+	OperatingSystem   string
+	Transcoder        TranscoderInfo
+	PlexPass          bool // Plex only
+	Latency           time.Duration
+}
+
+type TranscoderInfo struct {
+	Video                bool
+	Audio                bool
+	HardwareAcceleration string // e.g. "vaapi", "nvenc", empty when disabled or unknown
+}
+
+// HealthReport says whether a server is reachable and the credential can do what this package needs
+type HealthReport struct {
+	Service         string
+	Address         string
+	Reachable       bool
+	Authenticated   bool
+	CanReadSessions bool
+	CanControl      bool // kill sessions and send messages
+	Latency         time.Duration
+	Problems        []string
+}
+
+func (h HealthReport) Healthy() bool {
+	return h.Reachable && h.Authenticated && h.CanReadSessions
+}
+
+type jellySystemInfo struct {
+	ServerName                 string `json:"ServerName"`
+	Version                    string `json:"Version"`
+	ID                         string `json:"Id"`
+	OperatingSystem            string `json:"OperatingSystem"`
+	OperatingSystemDisplayName string `json:"OperatingSystemDisplayName"`
+}
+
+type jellyEncodingConfig struct {
+	HardwareAccelerationType string `json:"HardwareAccelerationType"`
+}
+
+type plexIdentity struct {
+	MachineIdentifier string `xml:"machineIdentifier,attr"`
+	Version           string `xml:"version,attr"`
+}
+
+type plexRoot struct {
+	FriendlyName       string `xml:"friendlyName,attr"`
+	MachineIdentifier  string `xml:"machineIdentifier,attr"`
+	Version            string `xml:"version,attr"`
+	Platform           string `xml:"platform,attr"`
+	PlatformVersion    string `xml:"platformVersion,attr"`
+	TranscoderVideo    string `xml:"transcoderVideo,attr"`
+	TranscoderAudio    string `xml:"transcoderAudio,attr"`
+	MyPlexSubscription string `xml:"myPlexSubscription,attr"`
+}
+
+// GET a url and return the body and how long the round trip took, non-2xx responses are a *StatusError
+func probe(backend, url string) (body []byte, latency time.Duration, err error) {
+	start := time.Now()
+	resp, err := HTTPClient.Get(url)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	latency = time.Since(start)
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, latency, err
+	}
+	return body, latency, checkResponse(backend, endpointPath(url), resp, body)
+}
+
+// Get Jellyfin identity from /System/Info, falls back to the public info for non-admin keys
+func GetJellyServerInfo(jellyfinAddress, jellyfinApiKey string) (info ServerInfo, err error) {
+	info = ServerInfo{Service: "Jellyfin", Address: jellyfinAddress}
+	body, latency, err := probe("jellyfin", jellyfinAddress+"/System/Info?api_key="+jellyfinApiKey)
+	info.Latency = latency
+	if errors.Is(err, ErrUnauthorized) {
+		body, _, err = probe("jellyfin", jellyfinAddress+"/System/Info/Public")
+	}
+	if err != nil {
+		return info, err
+	}
+	var system jellySystemInfo
+	if err := json.Unmarshal(body, &system); err != nil {
+		return info, fmt.Errorf("failed to decode jellyfin system info: %v", err)
+	}
+	info.ServerName = system.ServerName
+	info.Version = system.Version
+	info.MachineIdentifier = system.ID
+	info.OperatingSystem = system.OperatingSystemDisplayName
+	if info.OperatingSystem == "" {
+		info.OperatingSystem = system.OperatingSystem
+	}
+
+	// Jellyfin always ships ffmpeg, only hardware acceleration is configurable
+	info.Transcoder = TranscoderInfo{Video: true, Audio: true}
+	body, _, err = probe("jellyfin", jellyfinAddress+"/System/Configuration/encoding?api_key="+jellyfinApiKey)
+	if err == nil {
+		var encoding jellyEncodingConfig
+		if json.Unmarshal(body, &encoding) == nil && encoding.HardwareAccelerationType != "none" {
+			info.Transcoder.HardwareAcceleration = encoding.HardwareAccelerationType
+		}
+	}
+	return info, nil
+}
+
+// Get Plex identity from /identity and the server root
+func GetPlexServerInfo(plexAddress, plexApiKey string) (info ServerInfo, err error) {
+	info = ServerInfo{Service: "Plex", Address: plexAddress}
+	body, latency, err := probe("plex", plexAddress+"/identity")
+	if err != nil {
+		return info, err
+	}
+	info.Latency = latency
+	var identity plexIdentity
+	if err := xml.Unmarshal(body, &identity); err != nil {
+		return info, fmt.Errorf("failed to decode plex identity: %v", err)
+	}
+	info.MachineIdentifier = identity.MachineIdentifier
+	info.Version = identity.Version
+
+	body, _, err = probe("plex", plexAddress+"/?X-Plex-Token="+plexApiKey)
+	if err != nil {
+		return info, err
+	}
+	var root plexRoot
+	if err := xml.Unmarshal(body, &root); err != nil {
+		return info, fmt.Errorf("failed to decode plex root: %v", err)
+	}
+	info.ServerName = root.FriendlyName
+	info.OperatingSystem = root.Platform
+	if root.PlatformVersion != "" {
+		info.OperatingSystem += " " + root.PlatformVersion
+	}
+	info.Transcoder = TranscoderInfo{Video: root.TranscoderVideo == "1", Audio: root.TranscoderAudio == "1"}
+	info.PlexPass = root.MyPlexSubscription == "1"
+	return info, nil
+}
+
+// Check that Jellyfin answers and the api key can read and control sessions (admin)
+func CheckJellyHealth(jellyfinAddress, jellyfinApiKey string) HealthReport {
+	report := HealthReport{Service: "Jellyfin", Address: jellyfinAddress}
+	if !checkReachable(&report, jellyfinAddress+"/System/Info/Public") {
+		return report
+	}
+
+	_, _, err := probe("jellyfin", jellyfinAddress+"/Sessions?api_key="+jellyfinApiKey)
+	checkSessions(&report, err)
+	// Admin-only endpoint, the same policy guards session control
+	_, _, err = probe("jellyfin", jellyfinAddress+"/System/Info?api_key="+jellyfinApiKey)
+	report.CanControl = err == nil
+	switch {
+	case errors.Is(err, ErrUnauthorized) && report.Authenticated:
+		report.Problems = append(report.Problems, "api key is not an administrator, sessions can't be stopped or messaged")
+	case err != nil && !errors.Is(err, ErrUnauthorized):
+		report.Problems = append(report.Problems, fmt.Sprintf("checking admin access: %v", err))
+	}
+	return report
+}
+
+// Check that Plex answers and the token belongs to the server owner
+func CheckPlexHealth(plexAddress, plexApiKey string) HealthReport {
+	report := HealthReport{Service: "Plex", Address: plexAddress}
+	if !checkReachable(&report, plexAddress+"/identity") {
+		return report
+	}
+
+	_, _, err := probe("plex", plexAddress+"/status/sessions?X-Plex-Token="+plexApiKey)
+	checkSessions(&report, err)
+	if errors.Is(err, ErrUnauthorized) {
+		report.Problems[len(report.Problems)-1] += ", the token must belong to the server owner"
+	}
+	info, err := GetPlexServerInfo(plexAddress, plexApiKey)
+	if err != nil {
+		report.Problems = append(report.Problems, fmt.Sprintf("reading server info: %v", err))
+		return report
+	}
+	report.CanControl = report.CanReadSessions && info.PlexPass
+	if !info.PlexPass {
+		report.Problems = append(report.Problems, "server has no Plex Pass, sessions can't be terminated")
+	}
+	return report
+}
+
+// Probe the unauthenticated endpoint that identifies the server
+func checkReachable(report *HealthReport, url string) bool {
+	_, latency, err := probe(strings.ToLower(report.Service), url)
+	var statusErr *StatusError
+	switch {
+	case errors.As(err, &statusErr):
+		report.Problems = append(report.Problems, fmt.Sprintf("%v, is this a %s server?", err, report.Service))
+	case err != nil:
+		report.Problems = append(report.Problems, fmt.Sprintf("unreachable: %v", err))
+	}
+	report.Reachable = err == nil
+	report.Latency = latency
+	return report.Reachable
+}
+
+func checkSessions(report *HealthReport, err error) {
+	var statusErr *StatusError
+	report.CanReadSessions = err == nil
+	report.Authenticated = err == nil || errors.As(err, &statusErr) && statusErr.StatusCode != http.StatusUnauthorized
+	if err != nil {
+		report.Problems = append(report.Problems, fmt.Sprintf("reading sessions: %v", err))
+	}
+}
+
+// Check every configured server, same address/key convention as GetAllSessions
+func CheckHealth(jellyfinAddress, jellyfinApiKey, plexAddress, plexApiKey string) (reports []HealthReport) {
+	if jellyfinAddress != "" || jellyfinApiKey != "" {
+		reports = append(reports, CheckJellyHealth(jellyfinAddress, jellyfinApiKey))
+	}
+	if plexAddress != "" || plexApiKey != "" {
+		reports = append(reports, CheckPlexHealth(plexAddress, plexApiKey))
+	}
+	return reports
+}
@@ -0,0 +1,65 @@
+package jellyplexgatherer
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Janczykkkko/jellyplexgatherer/testserver"
+)
+
+func TestCheckPlexHealth(t *testing.T) {
+	plex := testserver.NewPlex("plextoken")
+	defer plex.Close()
+	plex.PlexPass = true
+
+	if report := CheckPlexHealth(plex.URL, "plextoken"); !report.Healthy() || !report.CanControl || len(report.Problems) != 0 {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	report := CheckPlexHealth(plex.URL, "wrong")
+	if report.Authenticated || report.CanReadSessions || len(report.Problems) == 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if problem := report.Problems[0]; !strings.Contains(problem, "401") || !strings.Contains(problem, "server owner") {
+		t.Errorf("unexpected problem %q", problem)
+	}
+	if _, err := GetPlexServerInfo(plex.URL, "wrong"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("got %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestCheckJellyHealthSessionsUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/System/Info/Public":
+			w.Write([]byte(`{"ServerName":"Jelly"}`))
+		case "/Sessions":
+			// Drop the connection without answering
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		default:
+			http.Error(w, "", http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	report := CheckJellyHealth(server.URL, "jellykey")
+	if !report.Reachable || report.Authenticated || report.CanReadSessions || report.CanControl {
+		t.Errorf("unexpected report %+v", report)
+	}
+	if len(report.Problems) != 1 || !strings.HasPrefix(report.Problems[0], "reading sessions: ") || strings.Contains(report.Problems[0], "200") {
+		t.Errorf("network error not reported: %q", report.Problems)
+	}
+}
+
+func TestCheckJellyHealthNotJellyfin(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	report := CheckJellyHealth(server.URL, "jellykey")
+	if report.Reachable || len(report.Problems) != 1 || !strings.Contains(report.Problems[0], "jellyfin /System/Info/Public returned 404 Not Found") {
+		t.Errorf("unexpected report %+v", report)
+	}
+}
@@ -0,0 +1,186 @@
+package jellyplexgatherer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	ErrPermissionDenied    = errors.New("server denied the request, check the api key permissions")
+	ErrPlexPassRequired    = errors.New("plex pass is required for this request")
+	ErrSessionNotFound     = errors.New("session not found")
+	ErrUnknownService      = errors.New("unknown session service")
+	ErrMessageNotSupported = errors.New("client does not support on-screen messages")
+)
+
+type KillOptions struct {
+	Reason string // shown to the user, Plex only
+	DryRun bool   // only log what would be stopped
+}
+
+// Stop a stream on whichever server the session belongs to
+func KillSession(jellyfinAddress, jellyfinApiKey, plexAddress, plexApiKey string, session SessionData, opts KillOptions) error {
+	if session.SessionID == "" {
+		return fmt.Errorf("%w: session of %s on %s has no id", ErrSessionNotFound, session.UserName, session.DeviceName)
+	}
+	switch session.Service {
+	case "Jellyfin":
+		return KillJellySession(jellyfinAddress, jellyfinApiKey, session.SessionID, opts)
+	case "Plex":
+		return KillPlexSession(plexAddress, plexApiKey, session.SessionID, opts)
+	}
+	return fmt.Errorf("%w: %q", ErrUnknownService, session.Service)
+}
+
+// Terminate a Plex stream, needs an owner token and Plex Pass
+func KillPlexSession(plexAddress, plexApiKey, sessionID string, opts KillOptions) error {
+	query := url.Values{}
+	query.Set("sessionId", sessionID)
+	query.Set("reason", opts.Reason)
+	query.Set("X-Plex-Token", plexApiKey)
+	endpoint := plexAddress + "/status/sessions/terminate?" + query.Encode()
+	if opts.DryRun {
+		logger().Info("dry run: would terminate session", "backend", "plex", "server", plexAddress, "session", sessionID, "reason", opts.Reason)
+		return nil
+	}
+	if err := controlRequest("plex", http.MethodGet, endpoint, nil); err != nil {
+		// Plex answers 403 when the server has no Plex Pass
+		return controlError("terminating Plex session "+sessionID, err, ErrPlexPassRequired)
+	}
+	return nil
+}
+
+// Stop playback of a Jellyfin session
+func KillJellySession(jellyfinAddress, jellyfinApiKey, sessionID string, opts KillOptions) error {
+	endpoint := fmt.Sprintf("%s/Sessions/%s/Playing/Stop?api_key=%s", jellyfinAddress, url.PathEscape(sessionID), url.QueryEscape(jellyfinApiKey))
+	if opts.DryRun {
+		logger().Info("dry run: would stop session", "backend", "jellyfin", "server", jellyfinAddress, "session", sessionID)
+		return nil
+	}
+	if err := controlRequest("jellyfin", http.MethodPost, endpoint, nil); err != nil {
+		return controlError("stopping Jellyfin session "+sessionID, err, ErrPermissionDenied)
+	}
+	return nil
+}
+
+type Message struct {
+	Header  string
+	Text    string
+	Timeout time.Duration // how long the client shows it, 0 leaves it to the client
+}
+
+// Show an on-screen message on the session's client
+func SendMessage(jellyfinAddress, jellyfinApiKey, plexAddress, plexApiKey string, session SessionData, msg Message) error {
+	if session.SessionID == "" {
+		return fmt.Errorf("%w: session of %s on %s has no id", ErrSessionNotFound, session.UserName, session.DeviceName)
+	}
+	switch session.Service {
+	case "Jellyfin":
+		return SendJellyMessage(jellyfinAddress, jellyfinApiKey, session.SessionID, msg)
+	case "Plex":
+		return SendPlexMessage(plexAddress, plexApiKey, session.SessionID, msg)
+	}
+	return fmt.Errorf("%w: %q", ErrUnknownService, session.Service)
+}
+
+// Post a DisplayMessage command to a Jellyfin session, checking the client's capabilities first
+func SendJellyMessage(jellyfinAddress, jellyfinApiKey, sessionID string, msg Message) error {
+	sessions, err := getJellySessionSummaries(jellyfinAddress, jellyfinApiKey, JellySessionOptions{})
+	if err != nil {
+		return err
+	}
+	var target *jellySessionSummary
+	for i := range sessions {
+		if sessions[i].ID == sessionID {
+			target = &sessions[i]
+			break
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("messaging Jellyfin session %s: %w", sessionID, ErrSessionNotFound)
+	}
+	if !jellySupportsCommand(*target, "DisplayMessage") {
+		return fmt.Errorf("messaging Jellyfin session %s (%s): %w", sessionID, target.Client, ErrMessageNotSupported)
+	}
+
+	payload := struct {
+		Header    string `json:"Header"`
+		Text      string `json:"Text"`
+		TimeoutMs int64  `json:"TimeoutMs,omitempty"`
+	}{msg.Header, msg.Text, msg.Timeout.Milliseconds()}
+	endpoint := fmt.Sprintf("%s/Sessions/%s/Message?api_key=%s", jellyfinAddress, url.PathEscape(sessionID), url.QueryEscape(jellyfinApiKey))
+	if err := controlRequest("jellyfin", http.MethodPost, endpoint, payload); err != nil {
+		return controlError("messaging Jellyfin session "+sessionID, err, ErrPermissionDenied)
+	}
+	return nil
+}
+
+// Plex Media Server has no API for pushing arbitrary text to a client. The only message a
+// Plex user ever sees from the server is the termination reason, see KillPlexSession.
+func SendPlexMessage(plexAddress, plexApiKey, sessionID string, msg Message) error {
+	return fmt.Errorf("messaging Plex session %s: %w, use KillOptions.Reason when terminating instead", sessionID, ErrMessageNotSupported)
+}
+
+// Capabilities moved around between Jellyfin versions, check both places. Both lists are
+// ranged over rather than appended, appending could write into the session's own slice.
+func jellySupportsCommand(session jellySessionSummary, command string) bool {
+	for _, commands := range [][]string{session.Capabilities.SupportedCommands, session.SupportedCommands} {
+		for _, supported := range commands {
+			if supported == command {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Fire a control request with an optional JSON payload, non-2xx responses are a *StatusError
+func controlRequest(backend, method, endpoint string, payload interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(withoutRetries(context.Background()), method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, resp.Body)
+	return checkResponse(backend, endpointPath(endpoint), resp, nil)
+}
+
+// Add what a failed control request means for the action. The *StatusError stays in the
+// chain for errors.As, forbidden is what a 403 means on this server.
+func controlError(action string, err error, forbidden error) error {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return fmt.Errorf("%s: %w", action, err)
+	}
+	switch statusErr.StatusCode {
+	case http.StatusUnauthorized:
+		return fmt.Errorf("%s: %w: %w", action, ErrPermissionDenied, err)
+	case http.StatusForbidden:
+		return fmt.Errorf("%s: %w: %w", action, forbidden, err)
+	case http.StatusNotFound:
+		return fmt.Errorf("%s: %w: %w", action, ErrSessionNotFound, err)
+	}
+	return fmt.Errorf("%s: %w", action, err)
+}
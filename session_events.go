@@ -0,0 +1,312 @@
+package jellyplexgatherer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session event types pushed by SessionWatcher
+const (
+	EventSessionStart  = "start"
+	EventSessionStop   = "stop"
+	EventSessionPause  = "pause"
+	EventSessionResume = "resume"
+	EventSnapshot      = "snapshot"
+	EventError         = "error"
+)
+
+// How often Run polls when Interval isn't set
+const defaultWatchInterval = 10 * time.Second
+
+// Services whose errors SessionWatcher can tell apart in GetAllSessions' error string
+var watchedServices = []string{"Jellyfin", "Plex"}
+
+// SessionEvent is a single change (or full snapshot) derived from polling GetAllSessions.
+// Session is set for start/stop/pause/resume, Sessions for snapshots, Service and Error for
+// errors. A snapshot is sent after every successful poll, so consumers acting on snapshots
+// also run while nothing changes.
+type SessionEvent struct {
+	ID       uint64        `json:"id"`
+	Type     string        `json:"type"`
+	Time     time.Time     `json:"time"`
+	Session  *SessionData  `json:"session,omitempty"`
+	Sessions []SessionData `json:"sessions,omitempty"`
+	Service  string        `json:"service,omitempty"`
+	Error    string        `json:"error,omitempty"`
+
+	repeat bool // snapshot of an unchanged poll, not kept for resume or sent over SSE
+}
+
+// SessionWatcher polls GetAllSessions, diffs the results and fans out events to subscribers.
+// It also serves them as Server-Sent Events, see ServeHTTP.
+type SessionWatcher struct {
+	Interval   time.Duration // defaults to 10s
+	BufferSize int           // how many past events are kept for Last-Event-ID resume
+
+	poll func() ([]SessionData, string)
+
+	mu          sync.Mutex
+	lastID      uint64
+	current     map[string]SessionData
+	failing     map[string]string // service -> error of its last poll
+	history     []SessionEvent
+	subscribers map[chan SessionEvent]struct{}
+}
+
+// NewSessionWatcher creates a watcher polling both servers every interval
+func NewSessionWatcher(jellyfinAddress, jellyfinApiKey, plexAddress, plexApiKey string, interval time.Duration) *SessionWatcher {
+	return NewSessionWatcherFunc(func() ([]SessionData, string) {
+		return GetAllSessions(jellyfinAddress, jellyfinApiKey, plexAddress, plexApiKey)
+	}, interval)
+}
+
+// NewSessionWatcherFunc creates a watcher around a custom poll function with GetAllSessions' signature
+func NewSessionWatcherFunc(poll func() ([]SessionData, string), interval time.Duration) *SessionWatcher {
+	return &SessionWatcher{
+		Interval:    interval,
+		BufferSize:  256,
+		poll:        poll,
+		current:     make(map[string]SessionData),
+		subscribers: make(map[chan SessionEvent]struct{}),
+	}
+}
+
+// Run polls until the context is cancelled
+func (w *SessionWatcher) Run(ctx context.Context) {
+	interval := w.Interval
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		w.Poll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll runs a single poll and publishes resulting events. A failing backend keeps its
+// previous sessions, so it doesn't look like all of its streams stopped, and is reported
+// as an error event. The other backend's sessions are still applied.
+func (w *SessionWatcher) Poll() {
+	sessions, errors := w.poll()
+	failed := make(map[string]string)
+	for _, line := range strings.Split(errors, "\n") {
+		for _, service := range watchedServices {
+			if strings.Contains(line, "Error getting "+service+" sessions") {
+				failed[service] = line
+			}
+		}
+	}
+	if errors != "" && len(failed) == 0 {
+		// Can't tell which backend failed, so don't diff partial data
+		logger().Warn("skipping session watcher update", "error", errors)
+		return
+	}
+	w.update(sessions, failed, time.Now())
+}
+
+func (w *SessionWatcher) update(sessions []SessionData, failed map[string]string, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	first := w.lastID == 0
+
+	for _, service := range watchedServices {
+		message, ok := failed[service]
+		switch {
+		case ok && w.failing[service] != message:
+			logger().Warn("session watcher backend failing", "service", service, "error", message)
+			w.lastID++
+			w.dispatch(SessionEvent{ID: w.lastID, Type: EventError, Time: now, Service: service, Error: message})
+		case !ok && w.failing[service] != "":
+			logger().Info("session watcher backend recovered", "service", service)
+		}
+	}
+	w.failing = failed
+
+	next := make(map[string]SessionData, len(sessions))
+	for _, session := range sessions {
+		if _, ok := failed[session.Service]; !ok {
+			next[sessionKey(session)] = session
+		}
+	}
+	for key, session := range w.current {
+		if _, ok := failed[session.Service]; ok {
+			next[key] = session
+		}
+	}
+
+	changed := false
+	for key, old := range w.current {
+		session, ok := next[key]
+		if !ok || session.Name != old.Name {
+			w.publish(EventSessionStop, old, now)
+			changed = true
+		}
+	}
+	for _, session := range sessions {
+		if _, ok := failed[session.Service]; ok {
+			continue
+		}
+		old, ok := w.current[sessionKey(session)]
+		switch {
+		case !ok || old.Name != session.Name:
+			w.publish(EventSessionStart, session, now)
+		case old.State != "paused" && session.State == "paused":
+			w.publish(EventSessionPause, session, now)
+		case old.State == "paused" && session.State != "paused":
+			w.publish(EventSessionResume, session, now)
+		default:
+			continue
+		}
+		changed = true
+	}
+	w.current = next
+
+	if changed || first {
+		w.lastID++
+		w.dispatch(SessionEvent{ID: w.lastID, Type: EventSnapshot, Time: now, Sessions: w.snapshot()})
+	} else {
+		w.dispatch(SessionEvent{ID: w.lastID, Type: EventSnapshot, Time: now, Sessions: w.snapshot(), repeat: true})
+	}
+}
+
+// must be called with w.mu held
+func (w *SessionWatcher) publish(eventType string, session SessionData, now time.Time) {
+	w.lastID++
+	s := session
+	w.dispatch(SessionEvent{ID: w.lastID, Type: eventType, Time: now, Session: &s})
+}
+
+// must be called with w.mu held
+func (w *SessionWatcher) dispatch(event SessionEvent) {
+	if !event.repeat {
+		w.history = append(w.history, event)
+		if w.BufferSize > 0 && len(w.history) > w.BufferSize {
+			w.history = w.history[len(w.history)-w.BufferSize:]
+		}
+	}
+	for ch := range w.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// Slow subscriber, drop it rather than block polling
+			delete(w.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Sessions returns the sessions seen by the last successful poll
+func (w *SessionWatcher) Sessions() []SessionData {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.snapshot()
+}
+
+// must be called with w.mu held
+func (w *SessionWatcher) snapshot() []SessionData {
+	sessions := make([]SessionData, 0, len(w.current))
+	for _, session := range w.current {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// Subscribe returns a channel of events after lastEventID. If lastEventID is 0 or no longer
+// buffered, the subscriber starts with the current snapshot. Call the returned func to unsubscribe.
+func (w *SessionWatcher) Subscribe(lastEventID uint64) (<-chan SessionEvent, func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var backlog []SessionEvent
+	if lastEventID > 0 && lastEventID <= w.lastID && len(w.history) > 0 && w.history[0].ID <= lastEventID+1 {
+		for _, event := range w.history {
+			if event.ID > lastEventID {
+				backlog = append(backlog, event)
+			}
+		}
+	} else if w.lastID > 0 {
+		backlog = []SessionEvent{{ID: w.lastID, Type: EventSnapshot, Time: time.Now(), Sessions: w.snapshot()}}
+	}
+
+	ch := make(chan SessionEvent, len(backlog)+64)
+	for _, event := range backlog {
+		ch <- event
+	}
+	w.subscribers[ch] = struct{}{}
+
+	return ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if _, ok := w.subscribers[ch]; ok {
+			delete(w.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// ServeHTTP streams session events as Server-Sent Events, honouring the Last-Event-ID header
+func (w *SessionWatcher) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	var lastEventID uint64
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		lastEventID, _ = strconv.ParseUint(header, 10, 64)
+	}
+
+	events, unsubscribe := w.Subscribe(lastEventID)
+	defer unsubscribe()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(rw, ": keep-alive\n\n")
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.repeat {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				logger().Error("encoding session event failed", "event", event.ID, "error", err)
+				continue
+			}
+			fmt.Fprintf(rw, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+func sessionKey(session SessionData) string {
+	if session.SessionID != "" {
+		return session.Service + ":" + session.SessionID
+	}
+	return session.Service + ":" + session.UserName + ":" + session.DeviceName
+}
@@ -3,9 +3,16 @@ package jellyplexgatherer
 import (
 	"encoding/xml"
 	"fmt"
+	"net/http"
+	"strings"
 	"time"
 )
 
+// HTTPClient makes every request to Plex and Jellyfin. Replace it to set timeouts, proxies
+// or a RecordingTransport/ReplayTransport. Notification sinks and metric exporters have
+// their own Client field instead.
+var HTTPClient = http.DefaultClient
+
 func GetAllSessions(jellyfinAddress, jellyfinApiKey, plexAddress, plexApiKey string) (allSessions []SessionData, errors string) {
 	var jellySessions []SessionData
 	if jellyfinAddress != "" || jellyfinApiKey != "" {
@@ -28,13 +35,46 @@ func GetAllSessions(jellyfinAddress, jellyfinApiKey, plexAddress, plexApiKey str
 }
 
 type SessionData struct {
-	UserName   string
-	Name       string
-	Bitrate    string
-	PlayMethod string
-	SubStream  string
-	DeviceName string
-	Service    string
+	UserName      string
+	UserID        string // Jellyfin user id or Plex server account id, see PlexUsers for names
+	Name          string
+	Bitrate       string
+	PlayMethod    string
+	SubStream     string
+	DeviceName    string
+	Service       string
+	SessionID     string
+	State         string
+	IPAddress     string
+	PublicAddress string
+	DeviceID      string
+	VideoHeight   int     // what the client gets, the transcoder's output for transcodes
+	SourceHeight  int     // height of the media file, 0 when the server doesn't say
+	Location      string  // "lan" or "wan", see NetworkClassifier
+	Bandwidth     float64 // Mbps actually used on the wire, same unit as Bitrate
+	Media         MediaRef
+	Images        SessionImages `metric:"-"`
+}
+
+// Server-relative image paths, fetch them through an ArtworkProxy so tokens stay server side.
+// Plex avatars are absolute plex.tv URLs.
+type SessionImages struct {
+	Poster   string
+	Backdrop string
+	Avatar   string
+}
+
+// Plex knows the public address of clients behind NAT, Jellyfin only sees the remote end point
+func (s SessionData) PublicIP() string {
+	if s.PublicAddress != "" {
+		return s.PublicAddress
+	}
+	return s.IPAddress
+}
+
+// Both services report the play method in their own casing
+func (s SessionData) IsTranscode() bool {
+	return strings.EqualFold(s.PlayMethod, "transcode")
 }
 
 type PlexVideoSession struct {
@@ -65,7 +105,14 @@ type PlexVideoSession struct {
 	GrandparentTitle      string `xml:"grandparentTitle,attr"`
 	ParentTitle           string `xml:"parentTitle,attr"`
 	Index                 string `xml:"index,attr"`
-	Media                 struct {
+	ParentIndex           string `xml:"parentIndex,attr"`
+	ParentYear            string `xml:"parentYear,attr"`
+	GrandparentThumb      string `xml:"grandparentThumb,attr"`
+	GrandparentArt        string `xml:"grandparentArt,attr"`
+	Guids                 []struct {
+		ID string `xml:"id,attr"`
+	} `xml:"Guid"`
+	Media struct {
 		Text                  string `xml:",chardata"`
 		AspectRatio           string `xml:"aspectRatio,attr"`
 		AudioChannels         string `xml:"audioChannels,attr"`
@@ -280,7 +327,14 @@ type PlexSessions struct {
 		GrandparentTitle      string `xml:"grandparentTitle,attr"`
 		ParentTitle           string `xml:"parentTitle,attr"`
 		Index                 string `xml:"index,attr"`
-		Media                 struct {
+		ParentIndex           string `xml:"parentIndex,attr"`
+		ParentYear            string `xml:"parentYear,attr"`
+		GrandparentThumb      string `xml:"grandparentThumb,attr"`
+		GrandparentArt        string `xml:"grandparentArt,attr"`
+		Guids                 []struct {
+			ID string `xml:"id,attr"`
+		} `xml:"Guid"`
+		Media struct {
 			Text                  string `xml:",chardata"`
 			AspectRatio           string `xml:"aspectRatio,attr"`
 			AudioChannels         string `xml:"audioChannels,attr"`
@@ -462,123 +516,9 @@ type PlexSessions struct {
 			MinOffsetAvailable      string `xml:"minOffsetAvailable,attr"`
 		} `xml:"TranscodeSession"`
 	} `xml:"Video"`
-	Track struct {
-		Text                 string `xml:",chardata"`
-		AddedAt              string `xml:"addedAt,attr"`
-		Art                  string `xml:"art,attr"`
-		Duration             string `xml:"duration,attr"`
-		GrandparentArt       string `xml:"grandparentArt,attr"`
-		GrandparentGuid      string `xml:"grandparentGuid,attr"`
-		GrandparentKey       string `xml:"grandparentKey,attr"`
-		GrandparentRatingKey string `xml:"grandparentRatingKey,attr"`
-		GrandparentThumb     string `xml:"grandparentThumb,attr"`
-		GrandparentTitle     string `xml:"grandparentTitle,attr"`
-		Guid                 string `xml:"guid,attr"`
-		Index                string `xml:"index,attr"`
-		Key                  string `xml:"key,attr"`
-		LastViewedAt         string `xml:"lastViewedAt,attr"`
-		LibrarySectionID     string `xml:"librarySectionID,attr"`
-		LibrarySectionKey    string `xml:"librarySectionKey,attr"`
-		LibrarySectionTitle  string `xml:"librarySectionTitle,attr"`
-		ParentGuid           string `xml:"parentGuid,attr"`
-		ParentIndex          string `xml:"parentIndex,attr"`
-		ParentKey            string `xml:"parentKey,attr"`
-		ParentRatingKey      string `xml:"parentRatingKey,attr"`
-		ParentStudio         string `xml:"parentStudio,attr"`
-		ParentThumb          string `xml:"parentThumb,attr"`
-		ParentTitle          string `xml:"parentTitle,attr"`
-		ParentYear           string `xml:"parentYear,attr"`
-		RatingCount          string `xml:"ratingCount,attr"`
-		RatingKey            string `xml:"ratingKey,attr"`
-		SessionKey           string `xml:"sessionKey,attr"`
-		Thumb                string `xml:"thumb,attr"`
-		Title                string `xml:"title,attr"`
-		Type                 string `xml:"type,attr"`
-		UpdatedAt            string `xml:"updatedAt,attr"`
-		ViewCount            string `xml:"viewCount,attr"`
-		ViewOffset           string `xml:"viewOffset,attr"`
-		Media                struct {
-			Text          string `xml:",chardata"`
-			AudioChannels string `xml:"audioChannels,attr"`
-			AudioCodec    string `xml:"audioCodec,attr"`
-			Bitrate       string `xml:"bitrate,attr"`
-			Container     string `xml:"container,attr"`
-			Duration      string `xml:"duration,attr"`
-			ID            string `xml:"id,attr"`
-			Selected      string `xml:"selected,attr"`
-			Part          struct {
-				Text         string `xml:",chardata"`
-				Container    string `xml:"container,attr"`
-				Duration     string `xml:"duration,attr"`
-				File         string `xml:"file,attr"`
-				HasThumbnail string `xml:"hasThumbnail,attr"`
-				ID           string `xml:"id,attr"`
-				Key          string `xml:"key,attr"`
-				Size         string `xml:"size,attr"`
-				Decision     string `xml:"decision,attr"`
-				Selected     string `xml:"selected,attr"`
-				Stream       struct {
-					Text                 string `xml:",chardata"`
-					AlbumGain            string `xml:"albumGain,attr"`
-					AlbumPeak            string `xml:"albumPeak,attr"`
-					AlbumRange           string `xml:"albumRange,attr"`
-					AudioChannelLayout   string `xml:"audioChannelLayout,attr"`
-					BitDepth             string `xml:"bitDepth,attr"`
-					Bitrate              string `xml:"bitrate,attr"`
-					Channels             string `xml:"channels,attr"`
-					Codec                string `xml:"codec,attr"`
-					DisplayTitle         string `xml:"displayTitle,attr"`
-					ExtendedDisplayTitle string `xml:"extendedDisplayTitle,attr"`
-					Gain                 string `xml:"gain,attr"`
-					ID                   string `xml:"id,attr"`
-					Index                string `xml:"index,attr"`
-					Loudness             string `xml:"loudness,attr"`
-					Lra                  string `xml:"lra,attr"`
-					Peak                 string `xml:"peak,attr"`
-					SamplingRate         string `xml:"samplingRate,attr"`
-					Selected             string `xml:"selected,attr"`
-					StreamType           string `xml:"streamType,attr"`
-					Location             string `xml:"location,attr"`
-				} `xml:"Stream"`
-			} `xml:"Part"`
-		} `xml:"Media"`
-		Mood []struct {
-			Text   string `xml:",chardata"`
-			Filter string `xml:"filter,attr"`
-			ID     string `xml:"id,attr"`
-			Tag    string `xml:"tag,attr"`
-		} `xml:"Mood"`
-		User struct {
-			Text  string `xml:",chardata"`
-			ID    string `xml:"id,attr"`
-			Thumb string `xml:"thumb,attr"`
-			Title string `xml:"title,attr"`
-		} `xml:"User"`
-		Player struct {
-			Text              string `xml:",chardata"`
-			Address           string `xml:"address,attr"`
-			Device            string `xml:"device,attr"`
-			MachineIdentifier string `xml:"machineIdentifier,attr"`
-			Model             string `xml:"model,attr"`
-			Platform          string `xml:"platform,attr"`
-			PlatformVersion   string `xml:"platformVersion,attr"`
-			Product           string `xml:"product,attr"`
-			Profile           string `xml:"profile,attr"`
-			State             string `xml:"state,attr"`
-			Title             string `xml:"title,attr"`
-			Version           string `xml:"version,attr"`
-			Local             string `xml:"local,attr"`
-			Relayed           string `xml:"relayed,attr"`
-			Secure            string `xml:"secure,attr"`
-			UserID            string `xml:"userID,attr"`
-		} `xml:"Player"`
-		Session struct {
-			Text      string `xml:",chardata"`
-			ID        string `xml:"id,attr"`
-			Bandwidth string `xml:"bandwidth,attr"`
-			Location  string `xml:"location,attr"`
-		} `xml:"Session"`
-	} `xml:"Track"`
+	// Music sessions, same shape as Video. This used to be a single struct, which kept only
+	// the last track when several people were listening and was never read by the gatherer.
+	Track []PlexVideoSession `xml:"Track"`
 }
 
 type JellySessions []JellySession
@@ -921,15 +861,12 @@ type JellySession struct {
 			URL  string `json:"Url"`
 			Name string `json:"Name"`
 		} `json:"RemoteTrailers"`
-		ProviderIds struct {
-			Property1 string `json:"property1"`
-			Property2 string `json:"property2"`
-		} `json:"ProviderIds"`
-		IsHD     bool   `json:"IsHD"`
-		IsFolder bool   `json:"IsFolder"`
-		ParentID string `json:"ParentId"`
-		Type     string `json:"Type"`
-		People   []struct {
+		ProviderIds map[string]string `json:"ProviderIds"`
+		IsHD        bool              `json:"IsHD"`
+		IsFolder    bool              `json:"IsFolder"`
+		ParentID    string            `json:"ParentId"`
+		Type        string            `json:"Type"`
+		People      []struct {
 			Name            string `json:"Name"`
 			ID              string `json:"Id"`
 			Role            string `json:"Role"`
@@ -1104,19 +1041,16 @@ type JellySession struct {
 			Level                     int     `json:"Level"`
 			IsAnamorphic              bool    `json:"IsAnamorphic"`
 		} `json:"MediaStreams"`
-		VideoType        string `json:"VideoType"`
-		PartCount        int    `json:"PartCount"`
-		MediaSourceCount int    `json:"MediaSourceCount"`
-		ImageTags        struct {
-			Property1 string `json:"property1"`
-			Property2 string `json:"property2"`
-		} `json:"ImageTags"`
-		BackdropImageTags   []string `json:"BackdropImageTags"`
-		ScreenshotImageTags []string `json:"ScreenshotImageTags"`
-		ParentLogoImageTag  string   `json:"ParentLogoImageTag"`
-		ParentArtItemID     string   `json:"ParentArtItemId"`
-		ParentArtImageTag   string   `json:"ParentArtImageTag"`
-		SeriesThumbImageTag string   `json:"SeriesThumbImageTag"`
+		VideoType           string            `json:"VideoType"`
+		PartCount           int               `json:"PartCount"`
+		MediaSourceCount    int               `json:"MediaSourceCount"`
+		ImageTags           map[string]string `json:"ImageTags"`
+		BackdropImageTags   []string          `json:"BackdropImageTags"`
+		ScreenshotImageTags []string          `json:"ScreenshotImageTags"`
+		ParentLogoImageTag  string            `json:"ParentLogoImageTag"`
+		ParentArtItemID     string            `json:"ParentArtItemId"`
+		ParentArtImageTag   string            `json:"ParentArtImageTag"`
+		SeriesThumbImageTag string            `json:"SeriesThumbImageTag"`
 		ImageBlurHashes     struct {
 			Primary struct {
 				Property1 string `json:"property1"`
@@ -1418,15 +1352,12 @@ type JellySession struct {
 			URL  string `json:"Url"`
 			Name string `json:"Name"`
 		} `json:"RemoteTrailers"`
-		ProviderIds struct {
-			Property1 string `json:"property1"`
-			Property2 string `json:"property2"`
-		} `json:"ProviderIds"`
-		IsHD     bool   `json:"IsHD"`
-		IsFolder bool   `json:"IsFolder"`
-		ParentID string `json:"ParentId"`
-		Type     string `json:"Type"`
-		People   []struct {
+		ProviderIds map[string]string `json:"ProviderIds"`
+		IsHD        bool              `json:"IsHD"`
+		IsFolder    bool              `json:"IsFolder"`
+		ParentID    string            `json:"ParentId"`
+		Type        string            `json:"Type"`
+		People      []struct {
 			Name            string `json:"Name"`
 			ID              string `json:"Id"`
 			Role            string `json:"Role"`
@@ -1601,19 +1532,16 @@ type JellySession struct {
 			Level                     int     `json:"Level"`
 			IsAnamorphic              bool    `json:"IsAnamorphic"`
 		} `json:"MediaStreams"`
-		VideoType        string `json:"VideoType"`
-		PartCount        int    `json:"PartCount"`
-		MediaSourceCount int    `json:"MediaSourceCount"`
-		ImageTags        struct {
-			Property1 string `json:"property1"`
-			Property2 string `json:"property2"`
-		} `json:"ImageTags"`
-		BackdropImageTags   []string `json:"BackdropImageTags"`
-		ScreenshotImageTags []string `json:"ScreenshotImageTags"`
-		ParentLogoImageTag  string   `json:"ParentLogoImageTag"`
-		ParentArtItemID     string   `json:"ParentArtItemId"`
-		ParentArtImageTag   string   `json:"ParentArtImageTag"`
-		SeriesThumbImageTag string   `json:"SeriesThumbImageTag"`
+		VideoType           string            `json:"VideoType"`
+		PartCount           int               `json:"PartCount"`
+		MediaSourceCount    int               `json:"MediaSourceCount"`
+		ImageTags           map[string]string `json:"ImageTags"`
+		BackdropImageTags   []string          `json:"BackdropImageTags"`
+		ScreenshotImageTags []string          `json:"ScreenshotImageTags"`
+		ParentLogoImageTag  string            `json:"ParentLogoImageTag"`
+		ParentArtItemID     string            `json:"ParentArtItemId"`
+		ParentArtImageTag   string            `json:"ParentArtImageTag"`
+		SeriesThumbImageTag string            `json:"SeriesThumbImageTag"`
 		ImageBlurHashes     struct {
 			Primary struct {
 				Property1 string `json:"property1"`
@@ -1738,7 +1666,7 @@ type JellySession struct {
 		IsVideoDirect            bool     `json:"IsVideoDirect"`
 		IsAudioDirect            bool     `json:"IsAudioDirect"`
 		Bitrate                  int      `json:"Bitrate"`
-		Framerate                int      `json:"Framerate"`
+		Framerate                float64  `json:"Framerate"`
 		CompletionPercentage     float64  `json:"CompletionPercentage"`
 		Width                    int      `json:"Width"`
 		Height                   int      `json:"Height"`
@@ -1923,15 +1851,12 @@ type JellySession struct {
 			URL  string `json:"Url"`
 			Name string `json:"Name"`
 		} `json:"RemoteTrailers"`
-		ProviderIds struct {
-			Property1 string `json:"property1"`
-			Property2 string `json:"property2"`
-		} `json:"ProviderIds"`
-		IsHD     bool   `json:"IsHD"`
-		IsFolder bool   `json:"IsFolder"`
-		ParentID string `json:"ParentId"`
-		Type     string `json:"Type"`
-		People   []struct {
+		ProviderIds map[string]string `json:"ProviderIds"`
+		IsHD        bool              `json:"IsHD"`
+		IsFolder    bool              `json:"IsFolder"`
+		ParentID    string            `json:"ParentId"`
+		Type        string            `json:"Type"`
+		People      []struct {
 			Name            string `json:"Name"`
 			ID              string `json:"Id"`
 			Role            string `json:"Role"`
@@ -2106,19 +2031,16 @@ type JellySession struct {
 			Level                     int     `json:"Level"`
 			IsAnamorphic              bool    `json:"IsAnamorphic"`
 		} `json:"MediaStreams"`
-		VideoType        string `json:"VideoType"`
-		PartCount        int    `json:"PartCount"`
-		MediaSourceCount int    `json:"MediaSourceCount"`
-		ImageTags        struct {
-			Property1 string `json:"property1"`
-			Property2 string `json:"property2"`
-		} `json:"ImageTags"`
-		BackdropImageTags   []string `json:"BackdropImageTags"`
-		ScreenshotImageTags []string `json:"ScreenshotImageTags"`
-		ParentLogoImageTag  string   `json:"ParentLogoImageTag"`
-		ParentArtItemID     string   `json:"ParentArtItemId"`
-		ParentArtImageTag   string   `json:"ParentArtImageTag"`
-		SeriesThumbImageTag string   `json:"SeriesThumbImageTag"`
+		VideoType           string            `json:"VideoType"`
+		PartCount           int               `json:"PartCount"`
+		MediaSourceCount    int               `json:"MediaSourceCount"`
+		ImageTags           map[string]string `json:"ImageTags"`
+		BackdropImageTags   []string          `json:"BackdropImageTags"`
+		ScreenshotImageTags []string          `json:"ScreenshotImageTags"`
+		ParentLogoImageTag  string            `json:"ParentLogoImageTag"`
+		ParentArtItemID     string            `json:"ParentArtItemId"`
+		ParentArtImageTag   string            `json:"ParentArtImageTag"`
+		SeriesThumbImageTag string            `json:"SeriesThumbImageTag"`
 		ImageBlurHashes     struct {
 			Primary struct {
 				Property1 string `json:"property1"`
@@ -0,0 +1,359 @@
+package jellyplexgatherer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type GeoLocation struct {
+	Country   string
+	City      string
+	Latitude  float64
+	Longitude float64
+}
+
+func (l GeoLocation) String() string {
+	if l.City == "" {
+		return l.Country
+	}
+	return l.City + ", " + l.Country
+}
+
+// GeoLookup resolves an IP to a location, implementations must work offline
+type GeoLookup interface {
+	Lookup(ip net.IP) (GeoLocation, bool)
+}
+
+// SharingReport summarizes how one user's account was used within the detector's window
+type SharingReport struct {
+	UserName                 string
+	IPs                      []string
+	Devices                  []string
+	Locations                []string
+	MaxSimultaneousIPs       int // most distinct public addresses streaming at the same time
+	MaxSimultaneousLocations int
+	Score                    float64 // 0 (single household) to 1 (almost certainly shared)
+}
+
+// SharingDetector tracks public IPs, devices and locations per user over time to spot shared accounts.
+// Feed it every snapshot, private/LAN addresses all count as the one home location and don't
+// count towards simultaneous use. Simultaneous use is kept as a daily maximum.
+type SharingDetector struct {
+	Window time.Duration // how long observations count, defaults to 30 days
+	Geo    GeoLookup     // optional
+
+	mu    sync.Mutex
+	users map[string]*userActivity
+}
+
+type userActivity struct {
+	userName     string
+	ips          map[string]time.Time
+	devices      map[string]time.Time
+	locations    map[string]time.Time
+	simultaneous map[string]simultaneousUse // UTC day -> most simultaneous use that day
+}
+
+type simultaneousUse struct {
+	last      time.Time
+	ips       int
+	locations int
+}
+
+func NewSharingDetector(window time.Duration, geo GeoLookup) *SharingDetector {
+	return &SharingDetector{Window: window, Geo: geo, users: make(map[string]*userActivity)}
+}
+
+// Observe records one session snapshot
+func (d *SharingDetector) Observe(sessions []SessionData) {
+	d.observe(sessions, time.Now())
+}
+
+func (d *SharingDetector) observe(sessions []SessionData, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	users, byUser := sessionsByUser(sessions)
+	for _, user := range users {
+		activity, ok := d.users[user]
+		if !ok {
+			activity = &userActivity{
+				userName:     byUser[user][0].UserName,
+				ips:          make(map[string]time.Time),
+				devices:      make(map[string]time.Time),
+				locations:    make(map[string]time.Time),
+				simultaneous: make(map[string]simultaneousUse),
+			}
+			d.users[user] = activity
+		}
+		// Someone at home and someone on mobile data is one household, only public
+		// addresses count towards simultaneous use
+		ips := make(map[string]bool)
+		locations := make(map[string]bool)
+		for _, session := range byUser[user] {
+			ip, location := d.classify(session.PublicIP())
+			if ip != "lan" && ip != "unknown" {
+				ips[ip] = true
+				locations[location] = true
+			}
+			activity.ips[ip] = now
+			activity.locations[location] = now
+			device := session.DeviceID
+			if device == "" {
+				device = session.DeviceName
+			}
+			activity.devices[session.Service+":"+device] = now
+		}
+		if len(ips) > 1 {
+			day := now.UTC().Format(time.DateOnly)
+			use := activity.simultaneous[day]
+			activity.simultaneous[day] = simultaneousUse{
+				last:      now,
+				ips:       max(use.ips, len(ips)),
+				locations: max(use.locations, len(locations)),
+			}
+		}
+	}
+	d.prune(now)
+}
+
+// Private addresses are collapsed into "lan" so a household's devices don't look like sharing
+func (d *SharingDetector) classify(address string) (ip, location string) {
+	parsed := parseEndPoint(address)
+	if parsed == nil {
+		return "unknown", "unknown"
+	}
+	if parsed.IsPrivate() || parsed.IsLoopback() || parsed.IsLinkLocalUnicast() {
+		return "lan", "lan"
+	}
+	location = parsed.String()
+	if d.Geo != nil {
+		if geo, ok := d.Geo.Lookup(parsed); ok {
+			location = geo.String()
+		}
+	}
+	return parsed.String(), location
+}
+
+// must be called with d.mu held
+func (d *SharingDetector) prune(now time.Time) {
+	window := d.Window
+	if window <= 0 {
+		window = 30 * 24 * time.Hour
+	}
+	cutoff := now.Add(-window)
+	for user, activity := range d.users {
+		for _, seen := range []map[string]time.Time{activity.ips, activity.devices, activity.locations} {
+			for key, at := range seen {
+				if at.Before(cutoff) {
+					delete(seen, key)
+				}
+			}
+		}
+		for day, use := range activity.simultaneous {
+			if use.last.Before(cutoff) {
+				delete(activity.simultaneous, day)
+			}
+		}
+		if len(activity.ips) == 0 {
+			delete(d.users, user)
+		}
+	}
+}
+
+// Report returns one entry per user, most suspicious first
+func (d *SharingDetector) Report() []SharingReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	reports := make([]SharingReport, 0, len(d.users))
+	for _, activity := range d.users {
+		report := SharingReport{
+			UserName:  activity.userName,
+			IPs:       sortedKeys(activity.ips),
+			Devices:   sortedKeys(activity.devices),
+			Locations: sortedKeys(activity.locations),
+		}
+		report.MaxSimultaneousIPs = min(len(report.IPs), 1)
+		report.MaxSimultaneousLocations = min(len(report.Locations), 1)
+		for _, use := range activity.simultaneous {
+			report.MaxSimultaneousIPs = max(report.MaxSimultaneousIPs, use.ips)
+			report.MaxSimultaneousLocations = max(report.MaxSimultaneousLocations, use.locations)
+		}
+		report.Score = sharingScore(report)
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Score != reports[j].Score {
+			return reports[i].Score > reports[j].Score
+		}
+		return reports[i].UserName < reports[j].UserName
+	})
+	return reports
+}
+
+// Simultaneous streams from different places weigh the most, a long tail of
+// addresses and devices is normal for phones on mobile data so it weighs little.
+func sharingScore(report SharingReport) float64 {
+	score := 0.35*float64(report.MaxSimultaneousLocations-1) +
+		0.15*float64(report.MaxSimultaneousIPs-1) +
+		0.1*float64(max(len(report.Locations)-2, 0)) +
+		0.02*float64(max(len(report.IPs)-5, 0)) +
+		0.02*float64(max(len(report.Devices)-5, 0))
+	return math.Max(0, math.Min(1, score))
+}
+
+func sortedKeys(m map[string]time.Time) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// CSVGeoLookup reads the MaxMind GeoLite2/GeoIP2 City CSV export, kept in memory
+type CSVGeoLookup struct {
+	blocks4 []geoBlock
+	blocks6 []geoBlock
+}
+
+type geoBlock struct {
+	network  *net.IPNet
+	location GeoLocation
+}
+
+// Load a MaxMind City CSV pair, e.g. GeoLite2-City-Blocks-IPv4.csv and GeoLite2-City-Locations-en.csv.
+// Pass several blocks files to cover both IPv4 and IPv6.
+func LoadCSVGeoLookup(locationsFile string, blocksFiles ...string) (*CSVGeoLookup, error) {
+	locations, err := readGeoLocations(locationsFile)
+	if err != nil {
+		return nil, err
+	}
+	lookup := &CSVGeoLookup{}
+	for _, blocksFile := range blocksFiles {
+		if err := lookup.readBlocks(blocksFile, locations); err != nil {
+			return nil, err
+		}
+	}
+	for _, blocks := range [][]geoBlock{lookup.blocks4, lookup.blocks6} {
+		sort.Slice(blocks, func(i, j int) bool {
+			return bytes.Compare(blocks[i].network.IP, blocks[j].network.IP) < 0
+		})
+	}
+	return lookup, nil
+}
+
+func (l *CSVGeoLookup) Lookup(ip net.IP) (GeoLocation, bool) {
+	ip = normalizeIP(ip)
+	blocks := l.blocks6
+	if len(ip) == net.IPv4len {
+		blocks = l.blocks4
+	}
+	// Blocks don't overlap, so the candidate is the last one starting at or before ip
+	i := sort.Search(len(blocks), func(i int) bool {
+		return bytes.Compare(blocks[i].network.IP, ip) > 0
+	})
+	if i == 0 || !blocks[i-1].network.Contains(ip) {
+		return GeoLocation{}, false
+	}
+	return blocks[i-1].location, true
+}
+
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+func readCSVFile(path string) ([][]string, map[string]int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading %s header: %v", path, err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[name] = i
+	}
+	var rows [][]string
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading %s: %v", path, err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, columns, nil
+}
+
+func csvField(row []string, columns map[string]int, name string) string {
+	if i, ok := columns[name]; ok && i < len(row) {
+		return row[i]
+	}
+	return ""
+}
+
+func readGeoLocations(path string) (map[string]GeoLocation, error) {
+	rows, columns, err := readCSVFile(path)
+	if err != nil {
+		return nil, err
+	}
+	locations := make(map[string]GeoLocation, len(rows))
+	for _, row := range rows {
+		locations[csvField(row, columns, "geoname_id")] = GeoLocation{
+			Country: csvField(row, columns, "country_name"),
+			City:    csvField(row, columns, "city_name"),
+		}
+	}
+	return locations, nil
+}
+
+func (l *CSVGeoLookup) readBlocks(path string, locations map[string]GeoLocation) error {
+	rows, columns, err := readCSVFile(path)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		_, network, err := net.ParseCIDR(csvField(row, columns, "network"))
+		if err != nil {
+			continue
+		}
+		network.IP = normalizeIP(network.IP)
+		location := locations[csvField(row, columns, "geoname_id")]
+		if location == (GeoLocation{}) {
+			location = locations[csvField(row, columns, "registered_country_geoname_id")]
+		}
+		location.Latitude, _ = strconv.ParseFloat(csvField(row, columns, "latitude"), 64)
+		location.Longitude, _ = strconv.ParseFloat(csvField(row, columns, "longitude"), 64)
+		if strings.TrimSpace(location.Country) == "" && location.Latitude == 0 && location.Longitude == 0 {
+			continue
+		}
+		if len(network.IP) == net.IPv4len {
+			l.blocks4 = append(l.blocks4, geoBlock{network: network, location: location})
+		} else {
+			l.blocks6 = append(l.blocks6, geoBlock{network: network, location: location})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package jellyplexgatherer
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSharingDetector(t *testing.T) {
+	detector := NewSharingDetector(0, nil)
+	start := time.Date(2024, 1, 1, 20, 0, 0, 0, time.UTC)
+
+	// alice streams at home while someone in her household is on mobile data
+	household := []SessionData{
+		{Service: "Plex", UserName: "alice", DeviceID: "tv", IPAddress: "192.168.1.20"},
+		{Service: "Plex", UserName: "alice", DeviceID: "phone", IPAddress: "203.0.113.7"},
+	}
+	// bob's account streams from two public addresses at once
+	shared := []SessionData{
+		{Service: "Jellyfin", UserName: "bob", DeviceID: "tv", IPAddress: "198.51.100.1"},
+		{Service: "Jellyfin", UserName: "bob", DeviceID: "laptop", IPAddress: "198.51.100.200"},
+	}
+	for i := 0; i < 3*24*60; i++ {
+		detector.observe(append(append([]SessionData(nil), household...), shared...), start.Add(time.Duration(i)*time.Minute))
+	}
+
+	reports := detector.Report()
+	if len(reports) != 2 || reports[0].UserName != "bob" {
+		t.Fatalf("unexpected reports %+v", reports)
+	}
+	if reports[0].MaxSimultaneousIPs != 2 || reports[0].Score == 0 {
+		t.Errorf("bob's account looks unshared: %+v", reports[0])
+	}
+	if reports[1].MaxSimultaneousIPs != 1 || reports[1].MaxSimultaneousLocations != 1 {
+		t.Errorf("home and mobile counted as simultaneous sharing: %+v", reports[1])
+	}
+	// A minute of polling over three days is kept as three daily maxima
+	if days := len(detector.users["bob"].simultaneous); days > 4 {
+		t.Errorf("kept %d simultaneous use entries, want one per day", days)
+	}
+
+	// Everything ages out of the window
+	detector.observe(nil, start.Add(40*24*time.Hour))
+	if reports := detector.Report(); len(reports) != 0 {
+		t.Errorf("got reports after the window passed: %+v", reports)
+	}
+}
+
+func TestCSVGeoLookup(t *testing.T) {
+	dir := t.TempDir()
+	locations := filepath.Join(dir, "locations.csv")
+	blocks := filepath.Join(dir, "blocks.csv")
+	os.WriteFile(locations, []byte("geoname_id,country_name,city_name\n1,Netherlands,Amsterdam\n2,Poland,\n"), 0o644)
+	os.WriteFile(blocks, []byte("network,geoname_id,registered_country_geoname_id,latitude,longitude\n198.51.100.0/25,1,,52.37,4.89\n198.51.100.128/25,,2,,\n"), 0o644)
+
+	lookup, err := LoadCSVGeoLookup(locations, blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]string{"198.51.100.1": "Amsterdam, Netherlands", "198.51.100.200": "Poland", "203.0.113.1": ""} {
+		location, ok := lookup.Lookup(net.ParseIP(ip))
+		if location.String() != want || ok != (want != "") {
+			t.Errorf("%s: got %q (%v), want %q", ip, location, ok, want)
+		}
+	}
+}
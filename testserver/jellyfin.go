@@ -0,0 +1,282 @@
+package testserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Jellyfin is a fake Jellyfin server serving /Sessions, the stop and message session
+// commands, /System/ActivityLog/Entries and /System/Info/Public. Every endpoint but
+// /System/Info/Public needs the API key, as api_key or the X-Emby-Token header. /Sessions
+// honors the activeWithinSeconds, controllableByUserId and deviceId filters.
+type Jellyfin struct {
+	*httptest.Server
+	script
+
+	ApiKey  string
+	ID      string
+	Version string
+
+	activityMu sync.Mutex
+	activity   []Activity
+}
+
+// Activity is an activity log entry, e.g. {Name: "alice is online from Chrome", Type: "SessionStarted"}
+type Activity struct {
+	Name   string
+	Type   string
+	UserID string
+	Date   time.Time
+}
+
+func NewJellyfin(apiKey string) *Jellyfin {
+	j := &Jellyfin{ApiKey: apiKey, ID: "fakejellyfinserver", Version: "10.9.11"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/System/Info/Public", j.publicInfo)
+	mux.HandleFunc("/System/ActivityLog/Entries", j.authorized(j.activityLog))
+	mux.HandleFunc("/Sessions", j.authorized(j.sessions))
+	mux.HandleFunc("/Sessions/", j.authorized(j.command))
+	j.Server = httptest.NewServer(mux)
+	return j
+}
+
+// AddActivity appends entries to the activity log, which is served oldest last like Jellyfin does
+func (j *Jellyfin) AddActivity(entries ...Activity) {
+	j.activityMu.Lock()
+	defer j.activityMu.Unlock()
+	for _, entry := range entries {
+		if entry.Date.IsZero() {
+			entry.Date = time.Now().UTC()
+		}
+		j.activity = append([]Activity{entry}, j.activity...)
+	}
+}
+
+func (j *Jellyfin) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if j.intercept(w) {
+			return
+		}
+		key := r.URL.Query().Get("api_key")
+		if key == "" {
+			key = r.Header.Get("X-Emby-Token")
+		}
+		if key != j.ApiKey {
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (j *Jellyfin) publicInfo(w http.ResponseWriter, r *http.Request) {
+	if j.intercept(w) {
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"LocalAddress":           j.URL,
+		"ServerName":             "Fake Jellyfin",
+		"Version":                j.Version,
+		"ProductName":            "Jellyfin Server",
+		"OperatingSystem":        "",
+		"Id":                     j.ID,
+		"StartupWizardCompleted": true,
+	})
+}
+
+func (j *Jellyfin) activityLog(w http.ResponseWriter, r *http.Request) {
+	minDate, _ := time.Parse(time.RFC3339, r.URL.Query().Get("minDate"))
+	j.activityMu.Lock()
+	defer j.activityMu.Unlock()
+	items := []map[string]interface{}{}
+	for i, entry := range j.activity {
+		if entry.Date.Before(minDate) {
+			continue
+		}
+		items = append(items, map[string]interface{}{
+			"Id":       len(j.activity) - i,
+			"Name":     entry.Name,
+			"Type":     entry.Type,
+			"Date":     entry.Date,
+			"UserId":   entry.UserID,
+			"Severity": "Information",
+		})
+	}
+	writeJSON(w, map[string]interface{}{"Items": items, "TotalRecordCount": len(items), "StartIndex": 0})
+}
+
+// POST /Sessions/{id}/Playing/Stop and POST /Sessions/{id}/Message
+func (j *Jellyfin) command(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/Sessions/"), "/")
+	id := parts[0]
+	switch strings.Join(parts[1:], "/") {
+	case "Playing/Stop":
+		if !j.stop(id) {
+			http.NotFound(w, r)
+			return
+		}
+	case "Message":
+		var payload struct {
+			Header string `json:"Header"`
+			Text   string `json:"Text"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !j.playing(id) {
+			http.NotFound(w, r)
+			return
+		}
+		j.message(Message{SessionID: id, Header: payload.Header, Text: payload.Text})
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (j *Jellyfin) playing(id string) bool {
+	for _, session := range j.current() {
+		if session.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (j *Jellyfin) sessions(w http.ResponseWriter, r *http.Request) {
+	step := j.poll()
+	time.Sleep(step.Delay)
+	if serveFault(w, &step) {
+		return
+	}
+	query := r.URL.Query()
+	activeWithin, _ := strconv.Atoi(query.Get("activeWithinSeconds"))
+	sessions := []map[string]interface{}{}
+	for _, session := range step.Sessions {
+		switch {
+		case activeWithin > 0 && session.Inactive > time.Duration(activeWithin)*time.Second,
+			query.Has("controllableByUserId") && session.UserID != query.Get("controllableByUserId"),
+			query.Has("deviceId") && session.DeviceID != query.Get("deviceId"):
+			continue
+		}
+		sessions = append(sessions, jellySession(session))
+	}
+	writeJSON(w, sessions)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+const jellyTicksPerSecond = 10000000
+
+func jellySession(session Session) map[string]interface{} {
+	result := map[string]interface{}{
+		"Id":                 session.ID,
+		"UserId":             session.UserID,
+		"UserName":           session.UserName,
+		"Client":             session.Client,
+		"DeviceName":         session.DeviceName,
+		"DeviceId":           session.DeviceID,
+		"RemoteEndPoint":     session.RemoteAddress,
+		"ApplicationVersion": "10.9.11",
+		"IsActive":           true,
+		"LastActivityDate":   time.Now().Add(-session.Inactive).UTC(),
+		"Capabilities": map[string]interface{}{
+			"PlayableMediaTypes":   []string{"Video", "Audio"},
+			"SupportedCommands":    []string{"DisplayMessage", "SendString", "Play", "Playstate"},
+			"SupportsMediaControl": true,
+		},
+		"SupportedCommands": []string{"DisplayMessage", "SendString", "Play", "Playstate"},
+	}
+	if session.Idle {
+		result["PlayState"] = map[string]interface{}{"CanSeek": false, "IsPaused": false, "IsMuted": false, "RepeatMode": "RepeatNone"}
+		return result
+	}
+
+	itemType := "Movie"
+	if session.Type == "episode" {
+		itemType = "Episode"
+	}
+	streams := []map[string]interface{}{
+		{"Type": "Video", "Index": 0, "Codec": "h264", "BitRate": session.Bitrate * 1000, "Height": session.Height, "DisplayTitle": "1080p H264 SDR"},
+		{"Type": "Audio", "Index": 1, "Codec": "aac", "DisplayTitle": "English - AAC - Stereo - Default"},
+	}
+	subtitleIndex := -1
+	if session.Subtitle != "" {
+		subtitleIndex = len(streams)
+		streams = append(streams, map[string]interface{}{"Type": "Subtitle", "Index": subtitleIndex, "Codec": "subrip", "DisplayTitle": session.Subtitle})
+	}
+	item := map[string]interface{}{
+		"Name":           session.Title,
+		"Id":             "item" + session.ID,
+		"Type":           itemType,
+		"MediaType":      "Video",
+		"ProductionYear": session.Year,
+		"ProviderIds":    providerIDs(session.ProviderIDs),
+		"RunTimeTicks":   int64(7200) * jellyTicksPerSecond,
+		"ImageTags":      map[string]string{"Primary": "primarytag" + session.ID},
+		"MediaStreams":   streams,
+	}
+	if session.Type == "episode" {
+		item["SeriesName"] = session.SeriesTitle
+		item["SeriesId"] = "series" + session.ID
+		item["SeasonName"] = "Season " + strconv.Itoa(session.Season)
+		item["ParentIndexNumber"] = session.Season
+		item["IndexNumber"] = session.Episode
+	}
+	result["NowPlayingItem"] = item
+	result["FullNowPlayingItem"] = map[string]interface{}{"Container": "mkv", "Size": 4000000000, "Id": "item" + session.ID}
+
+	playMethod := "DirectPlay"
+	if session.Transcode {
+		playMethod = "Transcode"
+		result["TranscodingInfo"] = map[string]interface{}{
+			"AudioCodec":       "aac",
+			"VideoCodec":       "h264",
+			"Container":        "ts",
+			"IsVideoDirect":    false,
+			"IsAudioDirect":    false,
+			"Bitrate":          session.Bitrate * 1000,
+			"Height":           session.Height,
+			"TranscodeReasons": []string{"ContainerBitrateExceedsLimit"},
+		}
+	}
+	result["PlayState"] = map[string]interface{}{
+		"PositionTicks":       int64(600) * jellyTicksPerSecond,
+		"CanSeek":             true,
+		"IsPaused":            session.Paused,
+		"IsMuted":             false,
+		"PlayMethod":          playMethod,
+		"RepeatMode":          "RepeatNone",
+		"SubtitleStreamIndex": subtitleIndex,
+		"AudioStreamIndex":    1,
+		"MediaSourceId":       "item" + session.ID,
+	}
+	return result
+}
+
+// Jellyfin capitalizes provider names
+func providerIDs(ids map[string]string) map[string]string {
+	names := map[string]string{"imdb": "Imdb", "tmdb": "Tmdb", "tvdb": "Tvdb"}
+	result := make(map[string]string, len(ids))
+	for provider, id := range ids {
+		if name, ok := names[provider]; ok {
+			provider = name
+		}
+		result[provider] = id
+	}
+	return result
+}
@@ -0,0 +1,360 @@
+package testserver
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Plex is a fake Plex Media Server serving /status/sessions, /status/sessions/terminate,
+// /accounts, /identity and the server root. Every endpoint but /identity needs the token.
+//
+// It also stands in for plex.tv with /api/users and /api/home/users, point
+// jellyplexgatherer.PlexTVAddress at URL to use them.
+type Plex struct {
+	*httptest.Server
+	script
+
+	Token             string
+	MachineIdentifier string
+	Version           string
+	PlexPass          bool
+
+	accountsMu sync.Mutex
+	accounts   []Account
+}
+
+// Account is a user of the server. The owner has ID "1", Home users without a Username
+// are managed users, the rest are friends the server is shared with.
+type Account struct {
+	ID       string
+	PlexTVID string // the owner's plex.tv id, the server calls the owner 1
+	Name     string // the server's name for the account
+	Title    string // plex.tv title, what Plex apps show
+	Username string
+	Email    string
+	Home     bool
+}
+
+func NewPlex(token string) *Plex {
+	p := &Plex{Token: token, MachineIdentifier: "fake-plex-machine", Version: "1.40.0.0000", PlexPass: true}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/identity", p.identity)
+	mux.HandleFunc("/status/sessions", p.authorized(p.sessions))
+	mux.HandleFunc("/status/sessions/terminate", p.authorized(p.terminate))
+	mux.HandleFunc("/accounts", p.authorized(p.serverAccounts))
+	mux.HandleFunc("/api/users", p.authorized(p.sharedUsers))
+	mux.HandleFunc("/api/home/users", p.authorized(p.homeUsers))
+	mux.HandleFunc("/", p.authorized(p.root))
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+func (p *Plex) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p.intercept(w) {
+			return
+		}
+		token := r.URL.Query().Get("X-Plex-Token")
+		if token == "" {
+			token = r.Header.Get("X-Plex-Token")
+		}
+		if token != p.Token {
+			http.Error(w, "<html><body><h1>401 Unauthorized</h1></body></html>", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// SetAccounts replaces the server's accounts
+func (p *Plex) SetAccounts(accounts ...Account) {
+	p.accountsMu.Lock()
+	defer p.accountsMu.Unlock()
+	p.accounts = accounts
+}
+
+func (p *Plex) accountList() []Account {
+	p.accountsMu.Lock()
+	defer p.accountsMu.Unlock()
+	return append([]Account(nil), p.accounts...)
+}
+
+// GET /accounts, account 0 is the server itself
+func (p *Plex) serverAccounts(w http.ResponseWriter, r *http.Request) {
+	type account struct {
+		ID   string `xml:"id,attr"`
+		Key  string `xml:"key,attr"`
+		Name string `xml:"name,attr"`
+	}
+	container := struct {
+		XMLName xml.Name  `xml:"MediaContainer"`
+		Size    int       `xml:"size,attr"`
+		Account []account `xml:"Account"`
+	}{Account: []account{{ID: "0", Key: "/accounts/0"}}}
+	for _, a := range p.accountList() {
+		container.Account = append(container.Account, account{ID: a.ID, Key: "/accounts/" + a.ID, Name: a.Name})
+	}
+	container.Size = len(container.Account)
+	body, _ := xml.Marshal(container)
+	writeXML(w, xml.Header+string(body))
+}
+
+type plexTVUser struct {
+	ID         string `xml:"id,attr"`
+	Title      string `xml:"title,attr"`
+	Username   string `xml:"username,attr"`
+	Email      string `xml:"email,attr"`
+	Thumb      string `xml:"thumb,attr"`
+	Home       string `xml:"home,attr,omitempty"`
+	Admin      string `xml:"admin,attr,omitempty"`
+	Restricted string `xml:"restricted,attr"`
+}
+
+func (a Account) plexTV() plexTVUser {
+	user := plexTVUser{ID: a.ID, Title: a.Title, Username: a.Username, Email: a.Email, Restricted: "0"}
+	user.Thumb = "https://plex.tv/users/" + a.ID + "/avatar"
+	if a.ID == "1" && a.PlexTVID != "" {
+		user.ID = a.PlexTVID
+	}
+	if a.Home && a.Username == "" {
+		user.Restricted = "1"
+	}
+	return user
+}
+
+// GET plex.tv/api/users, everyone the owner shares with including home users
+func (p *Plex) sharedUsers(w http.ResponseWriter, r *http.Request) {
+	var users []plexTVUser
+	for _, a := range p.accountList() {
+		if a.ID == "1" {
+			continue
+		}
+		user := a.plexTV()
+		user.Home = "0"
+		if a.Home {
+			user.Home = "1"
+		}
+		users = append(users, user)
+	}
+	writePlexTVUsers(w, users)
+}
+
+// GET plex.tv/api/home/users, the owner and the home users
+func (p *Plex) homeUsers(w http.ResponseWriter, r *http.Request) {
+	var users []plexTVUser
+	for _, a := range p.accountList() {
+		if a.ID != "1" && !a.Home {
+			continue
+		}
+		user := a.plexTV()
+		user.Admin = "0"
+		if a.ID == "1" {
+			user.Admin = "1"
+		}
+		users = append(users, user)
+	}
+	writePlexTVUsers(w, users)
+}
+
+func writePlexTVUsers(w http.ResponseWriter, users []plexTVUser) {
+	body, _ := xml.Marshal(struct {
+		XMLName xml.Name     `xml:"MediaContainer"`
+		Size    int          `xml:"size,attr"`
+		User    []plexTVUser `xml:"User"`
+	}{Size: len(users), User: users})
+	writeXML(w, xml.Header+string(body))
+}
+
+func (p *Plex) identity(w http.ResponseWriter, r *http.Request) {
+	if p.intercept(w) {
+		return
+	}
+	writeXML(w, fmt.Sprintf(`<MediaContainer size="0" claimed="1" machineIdentifier="%s" version="%s"></MediaContainer>`, p.MachineIdentifier, p.Version))
+}
+
+func (p *Plex) root(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	pass := "0"
+	if p.PlexPass {
+		pass = "1"
+	}
+	writeXML(w, fmt.Sprintf(`<MediaContainer friendlyName="Fake Plex" machineIdentifier="%s" version="%s" platform="Linux" platformVersion="6.1" transcoderVideo="1" transcoderAudio="1" myPlexSubscription="%s"></MediaContainer>`,
+		p.MachineIdentifier, p.Version, pass))
+}
+
+func (p *Plex) terminate(w http.ResponseWriter, r *http.Request) {
+	if !p.PlexPass {
+		http.Error(w, "Plex Pass required", http.StatusForbidden)
+		return
+	}
+	id := r.URL.Query().Get("sessionId")
+	if !p.stop(id) {
+		http.NotFound(w, r)
+		return
+	}
+	p.message(Message{SessionID: id, Text: r.URL.Query().Get("reason")})
+	w.WriteHeader(http.StatusOK)
+}
+
+func (p *Plex) sessions(w http.ResponseWriter, r *http.Request) {
+	step := p.poll()
+	time.Sleep(step.Delay)
+	if serveFault(w, &step) {
+		return
+	}
+	container := plexContainer{Size: len(step.Sessions)}
+	for i, session := range step.Sessions {
+		container.Video = append(container.Video, plexVideo(session, i+1))
+	}
+	body, _ := xml.Marshal(container)
+	writeXML(w, xml.Header+string(body))
+}
+
+func writeXML(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "text/xml;charset=utf-8")
+	w.Write([]byte(body))
+}
+
+type plexContainer struct {
+	XMLName xml.Name       `xml:"MediaContainer"`
+	Size    int            `xml:"size,attr"`
+	Video   []plexVideoXML `xml:"Video"`
+}
+
+type plexAttr struct {
+	ID string `xml:"id,attr"`
+}
+
+type plexVideoXML struct {
+	Type             string     `xml:"type,attr"`
+	Title            string     `xml:"title,attr"`
+	GrandparentTitle string     `xml:"grandparentTitle,attr,omitempty"`
+	ParentTitle      string     `xml:"parentTitle,attr,omitempty"`
+	ParentIndex      string     `xml:"parentIndex,attr,omitempty"`
+	Index            string     `xml:"index,attr,omitempty"`
+	Year             string     `xml:"year,attr,omitempty"`
+	SessionKey       string     `xml:"sessionKey,attr"`
+	RatingKey        string     `xml:"ratingKey,attr"`
+	Guid             string     `xml:"guid,attr"`
+	Thumb            string     `xml:"thumb,attr"`
+	Art              string     `xml:"art,attr"`
+	Guids            []plexAttr `xml:"Guid"`
+	Media            struct {
+		Bitrate         string `xml:"bitrate,attr"`
+		Height          string `xml:"height,attr,omitempty"`
+		VideoResolution string `xml:"videoResolution,attr,omitempty"`
+		Part            struct {
+			Decision string `xml:"decision,attr"`
+			Stream   []struct {
+				StreamType           string `xml:"streamType,attr"`
+				ExtendedDisplayTitle string `xml:"extendedDisplayTitle,attr"`
+			} `xml:"Stream"`
+		} `xml:"Part"`
+	} `xml:"Media"`
+	User struct {
+		ID    string `xml:"id,attr"`
+		Title string `xml:"title,attr"`
+		Thumb string `xml:"thumb,attr"`
+	} `xml:"User"`
+	Player struct {
+		Address             string `xml:"address,attr"`
+		Device              string `xml:"device,attr"`
+		MachineIdentifier   string `xml:"machineIdentifier,attr"`
+		Product             string `xml:"product,attr"`
+		RemotePublicAddress string `xml:"remotePublicAddress,attr,omitempty"`
+		State               string `xml:"state,attr"`
+		Title               string `xml:"title,attr"`
+		Local               string `xml:"local,attr"`
+	} `xml:"Player"`
+	Session struct {
+		ID        string `xml:"id,attr"`
+		Bandwidth string `xml:"bandwidth,attr"`
+		Location  string `xml:"location,attr"`
+	} `xml:"Session"`
+	TranscodeSession *struct {
+		Key             string `xml:"key,attr"`
+		VideoDecision   string `xml:"videoDecision,attr"`
+		Throttled       string `xml:"throttled,attr"`
+		TranscodeHwFull string `xml:"transcodeHwFullPipeline,attr"`
+	} `xml:"TranscodeSession"`
+}
+
+func plexVideo(session Session, key int) plexVideoXML {
+	var video plexVideoXML
+	video.Type = session.Type
+	if video.Type == "" {
+		video.Type = "movie"
+	}
+	video.Title = session.Title
+	video.SessionKey = strconv.Itoa(key)
+	video.RatingKey = strconv.Itoa(1000 + key)
+	video.Guid = fmt.Sprintf("plex://%s/%d", video.Type, 1000+key)
+	video.Thumb = fmt.Sprintf("/library/metadata/%d/thumb/1700000000", 1000+key)
+	video.Art = fmt.Sprintf("/library/metadata/%d/art/1700000000", 1000+key)
+	if session.Year > 0 {
+		video.Year = strconv.Itoa(session.Year)
+	}
+	if video.Type == "episode" {
+		video.GrandparentTitle = session.SeriesTitle
+		video.ParentTitle = fmt.Sprintf("Season %d", session.Season)
+		video.ParentIndex = strconv.Itoa(session.Season)
+		video.Index = strconv.Itoa(session.Episode)
+	}
+	for _, provider := range []string{"imdb", "tmdb", "tvdb"} {
+		if id, ok := session.ProviderIDs[provider]; ok {
+			video.Guids = append(video.Guids, plexAttr{ID: provider + "://" + id})
+		}
+	}
+
+	video.Media.Bitrate = strconv.Itoa(session.Bitrate)
+	video.Media.Part.Decision = "directplay"
+	if session.Transcode {
+		video.Media.Part.Decision = "transcode"
+		video.TranscodeSession = &struct {
+			Key             string `xml:"key,attr"`
+			VideoDecision   string `xml:"videoDecision,attr"`
+			Throttled       string `xml:"throttled,attr"`
+			TranscodeHwFull string `xml:"transcodeHwFullPipeline,attr"`
+		}{Key: "/transcode/sessions/" + session.ID, VideoDecision: "transcode", Throttled: "0", TranscodeHwFull: "0"}
+	}
+	if session.Height > 0 {
+		video.Media.Height = strconv.Itoa(session.Height)
+		video.Media.VideoResolution = strconv.Itoa(session.Height)
+	}
+	if session.Subtitle != "" {
+		video.Media.Part.Stream = append(video.Media.Part.Stream, struct {
+			StreamType           string `xml:"streamType,attr"`
+			ExtendedDisplayTitle string `xml:"extendedDisplayTitle,attr"`
+		}{"3", session.Subtitle})
+	}
+
+	video.User.ID = session.UserID
+	video.User.Title = session.UserName
+	video.User.Thumb = "https://plex.tv/users/" + session.UserID + "/avatar"
+	video.Player.Address = session.RemoteAddress
+	video.Player.Device = session.DeviceName
+	video.Player.MachineIdentifier = session.DeviceID
+	video.Player.Product = session.Client
+	video.Player.Title = session.DeviceName
+	video.Player.State = "playing"
+	if session.Paused {
+		video.Player.State = "paused"
+	}
+	video.Player.Local = "0"
+	video.Session.Location = "wan"
+	if session.Local {
+		video.Player.Local = "1"
+		video.Session.Location = "lan"
+	}
+	video.Session.ID = session.ID
+	video.Session.Bandwidth = strconv.Itoa(session.Bitrate)
+	return video
+}
@@ -0,0 +1,190 @@
+// Package testserver provides fake Plex and Jellyfin servers built on httptest, for testing
+// code that uses jellyplexgatherer without standing up real media servers.
+//
+// Both fakes serve a list of Sessions. Scenarios are scripted as Steps, the fake moves to the
+// next step on every session poll and stays on the last one, so a test can say "nothing
+// playing, then alice starts a movie, then she pauses it, then the server returns 503".
+package testserver
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Session is a playback session as both fakes understand it
+type Session struct {
+	ID            string
+	UserID        string
+	UserName      string
+	DeviceID      string
+	DeviceName    string
+	Client        string
+	RemoteAddress string
+	Local         bool
+
+	Type        string // "movie" or "episode"
+	Title       string
+	SeriesTitle string
+	Season      int
+	Episode     int
+	Year        int
+	ProviderIDs map[string]string // imdb, tmdb, tvdb
+
+	Paused    bool
+	Idle      bool          // Jellyfin only: a connected client that isn't playing anything
+	Inactive  time.Duration // Jellyfin only: time since the client's last activity
+	Transcode bool
+	Bitrate   int // kbps
+	Height    int // transcoded height when Transcode is set
+	Subtitle  string
+}
+
+// Step is one state of a scripted scenario. A non-zero Status makes the session endpoint
+// fail with that status and Body instead of returning Sessions.
+type Step struct {
+	Sessions []Session
+	Status   int
+	Body     string
+	Delay    time.Duration
+}
+
+// script is the scenario state shared by both fakes
+type script struct {
+	mu       sync.Mutex
+	steps    []Step
+	next     int
+	fault    *Step
+	delay    time.Duration
+	polls    int
+	stopped  []string
+	messages []Message
+}
+
+// Message is an on-screen message or termination reason a client was sent
+type Message struct {
+	SessionID string
+	Header    string
+	Text      string
+}
+
+// SetSessions replaces the scenario with a single step serving sessions
+func (s *script) SetSessions(sessions ...Session) {
+	s.Play(Step{Sessions: sessions})
+}
+
+// Play replaces the scenario, each session poll advances one step
+func (s *script) Play(steps ...Step) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.steps = steps
+	s.next = 0
+}
+
+// SetFault makes every request fail with status and body until ClearFault
+func (s *script) SetFault(status int, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fault = &Step{Status: status, Body: body}
+}
+
+func (s *script) ClearFault() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fault = nil
+}
+
+// SetDelay slows every response down by d
+func (s *script) SetDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = d
+}
+
+// Polls returns how many times the session endpoint was hit
+func (s *script) Polls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.polls
+}
+
+// Stopped returns the ids of sessions that were terminated through the API
+func (s *script) Stopped() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.stopped...)
+}
+
+// Messages returns the messages sent to sessions through the API
+func (s *script) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// Current sessions without advancing the script
+func (s *script) current() []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.steps) == 0 {
+		return nil
+	}
+	return s.steps[max(s.next-1, 0)].Sessions
+}
+
+// Advance the script for a session poll and return the step to serve
+func (s *script) poll() Step {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.polls++
+	if len(s.steps) == 0 {
+		return Step{}
+	}
+	step := s.steps[min(s.next, len(s.steps)-1)]
+	if s.next < len(s.steps) {
+		s.next++
+	}
+	return step
+}
+
+// Remove a session from the current step, returns false if it isn't playing
+func (s *script) stop(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.steps) == 0 {
+		return false
+	}
+	step := &s.steps[max(s.next-1, 0)]
+	for i, session := range step.Sessions {
+		if session.ID == id {
+			step.Sessions = append(append([]Session(nil), step.Sessions[:i]...), step.Sessions[i+1:]...)
+			s.stopped = append(s.stopped, id)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *script) message(msg Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msg)
+}
+
+// Apply the global delay and fault, returns true if the request was answered
+func (s *script) intercept(w http.ResponseWriter) bool {
+	s.mu.Lock()
+	delay, fault := s.delay, s.fault
+	s.mu.Unlock()
+	time.Sleep(delay)
+	return serveFault(w, fault)
+}
+
+func serveFault(w http.ResponseWriter, step *Step) bool {
+	if step == nil || step.Status == 0 {
+		return false
+	}
+	w.WriteHeader(step.Status)
+	w.Write([]byte(step.Body))
+	return true
+}
@@ -0,0 +1,246 @@
+package jellyplexgatherer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Query parameters and headers that carry credentials, replaced before anything is written
+var (
+	redactedParams  = []string{"api_key", "ApiKey", "X-Plex-Token", "X-Emby-Token"}
+	redactedHeaders = []string{"Authorization", "X-Emby-Token", "X-Emby-Authorization", "X-MediaBrowser-Token", "X-Plex-Token", "Cookie", "Set-Cookie"}
+)
+
+var ErrNotRecorded = errors.New("no recorded response for request")
+
+// RecordedExchange is one request/response pair, stored as a line of JSON
+type RecordedExchange struct {
+	Time         time.Time
+	Method       string
+	URL          string // credentials redacted
+	RequestBody  string `json:",omitempty"`
+	Status       int
+	Header       http.Header
+	Body         string
+	BodyEncoding string `json:",omitempty"` // "base64" for binary bodies such as artwork
+	Error        string `json:",omitempty"` // transport error instead of a response
+}
+
+// RecordingTransport writes every request going through it and the response that came back
+// to a file, so a user can send in exactly what their servers returned:
+//
+//	recorder, err := jellyplexgatherer.NewRecordingTransport("traffic.jsonl", nil)
+//	jellyplexgatherer.HTTPClient = &http.Client{Transport: recorder}
+//	defer recorder.Close()
+type RecordingTransport struct {
+	Transport http.RoundTripper // nil uses http.DefaultTransport
+
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func NewRecordingTransport(path string, transport http.RoundTripper) (*RecordingTransport, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &RecordingTransport{Transport: transport, file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (t *RecordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	exchange := RecordedExchange{Time: time.Now().UTC(), Method: req.Method, URL: redactURL(req.URL)}
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		exchange.RequestBody = string(body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	transport := t.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		exchange.Error = err.Error()
+		return nil, errors.Join(err, t.write(exchange))
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	exchange.Status = resp.StatusCode
+	exchange.Header = redactHeader(resp.Header)
+	if utf8.Valid(body) {
+		exchange.Body = string(body)
+	} else {
+		exchange.Body = base64.StdEncoding.EncodeToString(body)
+		exchange.BodyEncoding = "base64"
+	}
+	if err := t.write(exchange); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (t *RecordingTransport) write(exchange RecordedExchange) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file == nil {
+		return errors.New("recording transport is closed")
+	}
+	return t.enc.Encode(exchange)
+}
+
+func (t *RecordingTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+// ReplayTransport answers requests from a RecordingTransport file without touching the network.
+// Requests are matched on method and redacted URL, falling back to method and path for URLs
+// with changing query parameters such as the activity log's minDate. Repeated requests get
+// the recorded responses in order, the last one is repeated once they run out.
+type ReplayTransport struct {
+	mu     sync.Mutex
+	byURL  map[string][]RecordedExchange
+	byPath map[string][]RecordedExchange
+	served map[string]int
+}
+
+func NewReplayTransport(path string) (*ReplayTransport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	t := &ReplayTransport{
+		byURL:  make(map[string][]RecordedExchange),
+		byPath: make(map[string][]RecordedExchange),
+		served: make(map[string]int),
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var exchange RecordedExchange
+		if err := json.Unmarshal(scanner.Bytes(), &exchange); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		parsed, err := url.Parse(exchange.URL)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		urlKey := exchange.Method + " " + exchange.URL
+		pathKey := exchange.Method + " " + parsed.Path
+		t.byURL[urlKey] = append(t.byURL[urlKey], exchange)
+		t.byPath[pathKey] = append(t.byPath[pathKey], exchange)
+	}
+	return t, scanner.Err()
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	t.mu.Lock()
+	exchange, ok := t.next("url:", t.byURL, req.Method+" "+redactURL(req.URL))
+	if !ok {
+		exchange, ok = t.next("path:", t.byPath, req.Method+" "+req.URL.Path)
+	}
+	t.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s %s", ErrNotRecorded, req.Method, redactURL(req.URL))
+	}
+	if exchange.Error != "" {
+		return nil, errors.New(exchange.Error)
+	}
+
+	body := []byte(exchange.Body)
+	if exchange.BodyEncoding == "base64" {
+		decoded, err := base64.StdEncoding.DecodeString(exchange.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = decoded
+	}
+	header := exchange.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", exchange.Status, http.StatusText(exchange.Status)),
+		StatusCode:    exchange.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+func (t *ReplayTransport) next(prefix string, index map[string][]RecordedExchange, key string) (RecordedExchange, bool) {
+	exchanges := index[key]
+	if len(exchanges) == 0 {
+		return RecordedExchange{}, false
+	}
+	n := t.served[prefix+key]
+	t.served[prefix+key]++
+	return exchanges[min(n, len(exchanges)-1)], true
+}
+
+func redactURL(u *url.URL) string {
+	redacted := *u
+	redacted.User = nil
+	query := redacted.Query()
+	changed := false
+	for _, param := range redactedParams {
+		if query.Has(param) {
+			query.Set(param, "REDACTED")
+			changed = true
+		}
+	}
+	if changed {
+		redacted.RawQuery = query.Encode()
+	}
+	return redacted.String()
+}
+
+func redactHeader(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range redactedHeaders {
+		if redacted.Get(name) != "" {
+			redacted.Set(name, "REDACTED")
+		}
+	}
+	return redacted
+}